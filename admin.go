@@ -0,0 +1,628 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// Admin serves the authenticated admin API used to inspect and repair the
+// cache. It is mounted on its own listener, separate from the proxy.
+type Admin struct {
+	proxy  *Proxy
+	cfg    *Config
+	logger *slog.Logger
+}
+
+// cachedVersion groups the cached files of a single module version.
+type cachedVersion struct {
+	Version string       `json:"version"`
+	Files   []cacheEntry `json:"files"`
+}
+
+func newAdmin(p *Proxy, cfg *Config, logger *slog.Logger) (*Admin, error) {
+	if cfg.Admin.Address == "" {
+		return nil, fmt.Errorf("missing admin address")
+	}
+	if cfg.Admin.Address == cfg.Server.Address {
+		return nil, fmt.Errorf("admin address must differ from the server address")
+	}
+	if cfg.Admin.Username == "" || cfg.Admin.Password == "" {
+		return nil, fmt.Errorf("admin username and password are required")
+	}
+
+	return &Admin{proxy: p, cfg: cfg, logger: logger}, nil
+}
+
+// Handler returns the admin API routes wrapped with basic auth.
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/cache/versions", a.handleListVersions)
+	mux.HandleFunc("GET /api/cache/entry", a.handleGetEntry)
+	mux.HandleFunc("DELETE /api/cache", a.handlePurge)
+	mux.HandleFunc("POST /api/cache/refetch", a.handleRefetch)
+	mux.HandleFunc("GET /api/policy", a.handleGetPolicy)
+	mux.HandleFunc("GET /api/policy/check", a.handleCheckPolicy)
+	mux.HandleFunc("POST /api/policy/reload", a.handleReloadPolicy)
+	mux.HandleFunc("GET /api/retractions", a.handleGetRetractions)
+	mux.HandleFunc("GET /api/licenses", a.handleGetLicenses)
+	mux.HandleFunc("PUT /api/publish", a.handlePublish)
+	mux.HandleFunc("POST /api/publish", a.handlePublish)
+	mux.HandleFunc("GET /api/vulndb/check", a.handleCheckVulns)
+	mux.HandleFunc("POST /api/vulndb/refresh", a.handleRefreshVulnDB)
+
+	return a.basicAuth(mux)
+}
+
+func (a *Admin) basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(a.cfg.Admin.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(a.cfg.Admin.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="toru-admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleListVersions lists the cached versions of a module.
+func (a *Admin) handleListVersions(w http.ResponseWriter, r *http.Request) {
+	if !a.requireCache(w) {
+		return
+	}
+	modulePath := r.URL.Query().Get("module")
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := a.proxy.cache.List(r.Context(), escapedPath+"/@v/")
+	if err != nil {
+		a.logger.Error("Failed to list cache", "module", modulePath, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list cache")
+		return
+	}
+
+	byVersion := make(map[string]*cachedVersion)
+	for _, e := range entries {
+		p, version, _, ok := parseCacheName(e.Name)
+		if !ok || p != modulePath {
+			continue
+		}
+		v, ok := byVersion[version]
+		if !ok {
+			v = &cachedVersion{Version: version}
+			byVersion[version] = v
+		}
+		v.Files = append(v.Files, e)
+	}
+
+	versions := make([]*cachedVersion, 0, len(byVersion))
+	for _, v := range byVersion {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"module":   modulePath,
+		"versions": versions,
+	})
+}
+
+// handleGetEntry returns the files and metadata of a cached module version.
+func (a *Admin) handleGetEntry(w http.ResponseWriter, r *http.Request) {
+	if !a.requireCache(w) {
+		return
+	}
+	modulePath, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	key, err := cacheKey(modulePath, version)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	files := []cacheEntry{}
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		e, err := a.proxy.cache.Stat(r.Context(), key+ext)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			a.logger.Error("Failed to stat cache entry", "name", key+ext, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to stat cache entry")
+			return
+		}
+		files = append(files, e)
+	}
+	if len(files) == 0 {
+		writeError(w, http.StatusNotFound, "version is not cached")
+		return
+	}
+
+	meta, err := readMeta(r.Context(), a.proxy.cache, modulePath, version)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		a.logger.Error("Failed to read cache metadata", "module", modulePath, "version", version, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read cache metadata")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"module":  modulePath,
+		"version": version,
+		"files":   files,
+		"meta":    meta,
+	})
+}
+
+// handlePurge deletes cached entries for a module, a module version or every
+// module whose path matches a glob pattern.
+func (a *Admin) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if !a.requireCache(w) {
+		return
+	}
+	var (
+		q          = r.URL.Query()
+		modulePath = q.Get("module")
+		version    = q.Get("version")
+		pattern    = q.Get("pattern")
+		purged     []string
+		err        error
+	)
+	if modulePath != "" && a.proxy.fetcher.hosted.owns(modulePath) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%s is a published module: its versions are immutable and can't be purged", modulePath))
+		return
+	}
+	switch {
+	case pattern != "":
+		if _, err := path.Match(pattern, ""); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid pattern: %v", err))
+			return
+		}
+		purged, err = a.purgePattern(r, pattern)
+	case modulePath != "" && version != "":
+		purged, err = a.purgeVersion(r, modulePath, version)
+	case modulePath != "":
+		purged, err = a.purgeModule(r, modulePath)
+	default:
+		writeError(w, http.StatusBadRequest, "one of module or pattern is required")
+		return
+	}
+	if err != nil {
+		a.logger.Error("Failed to purge cache", "module", modulePath, "version", version, "pattern", pattern, "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to purge cache: %v", err))
+		return
+	}
+
+	a.logger.Info("Purged cache entries", "module", modulePath, "version", version, "pattern", pattern, "count", len(purged))
+	cachePurgedTotal.Add(len(purged))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"purged": purged})
+}
+
+// handleRefetch downloads a module version again from upstream and replaces
+// the cached copy.
+func (a *Admin) handleRefetch(w http.ResponseWriter, r *http.Request) {
+	if !a.requireCache(w) {
+		return
+	}
+	modulePath, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	if _, err := cacheKey(modulePath, version); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if a.proxy.fetcher.hosted.owns(modulePath) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%s is a published module: it has no upstream to fetch it from", modulePath))
+		return
+	}
+
+	// The cached copy is only replaced once the new one is downloaded, so
+	// that it is still served if upstream fails.
+	startTime := time.Now()
+	if err := a.proxy.fetcher.storeVersion(r.Context(), modulePath, version); err != nil {
+		a.logger.Error("Failed to refetch module", "module", modulePath, "version", version, "error", err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("failed to refetch module: %v", err))
+		return
+	}
+
+	// The list and @latest entries may not include the version yet.
+	escapedPath, _ := module.EscapePath(modulePath)
+	if _, err := a.deleteAll(r, []string{escapedPath + "/@v/list", escapedPath + "/@latest"}); err != nil {
+		a.logger.Error("Failed to purge cache", "module", modulePath, "version", version, "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to purge cache: %v", err))
+		return
+	}
+
+	a.logger.Info("Refetched module", "module", modulePath, "version", version, "duration", time.Since(startTime))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"module":  modulePath,
+		"version": version,
+	})
+}
+
+// handleGetPolicy returns the policy rules in effect.
+func (a *Admin) handleGetPolicy(w http.ResponseWriter, r *http.Request) {
+	if !a.requirePolicy(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.fetcher.policy.rules())
+}
+
+// handleCheckPolicy reports whether the policy allows a module, or a version
+// of it.
+func (a *Admin) handleCheckPolicy(w http.ResponseWriter, r *http.Request) {
+	if !a.requirePolicy(w) {
+		return
+	}
+	modulePath, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	if err := module.CheckPath(modulePath); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rule, allowed := a.proxy.fetcher.policy.current.Load().decide(modulePath, version)
+	resp := map[string]interface{}{
+		"module":  modulePath,
+		"version": version,
+		"allowed": allowed,
+	}
+	if rule != nil {
+		resp["rule"] = rule.PolicyRule
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleReloadPolicy loads the policy file again.
+func (a *Admin) handleReloadPolicy(w http.ResponseWriter, r *http.Request) {
+	if !a.requirePolicy(w) {
+		return
+	}
+	if err := a.proxy.fetcher.policy.reload(); err != nil {
+		a.logger.Error("Failed to reload policy", "error", err)
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.fetcher.policy.rules())
+}
+
+// handleGetRetractions shows the retractions of a module and, if a version is
+// given, whether it is retracted. With refresh=true they are read again
+// rather than taken from memory.
+func (a *Admin) handleGetRetractions(w http.ResponseWriter, r *http.Request) {
+	if !a.requireRetractions(w) {
+		return
+	}
+	q := r.URL.Query()
+	modulePath, version := q.Get("module"), q.Get("version")
+	if err := module.CheckPath(modulePath); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if version != "" && !semver.IsValid(version) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid version %q", version))
+		return
+	}
+
+	f := a.proxy.fetcher
+	if q.Get("refresh") == "true" {
+		f.retractions.modules.Delete(modulePath)
+	}
+	m, err := f.retractionsOf(r.Context(), modulePath)
+	if err != nil {
+		a.logger.Error("Failed to read retractions", "module", modulePath, "error", err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("failed to read retractions: %v", err))
+		return
+	}
+
+	resp := map[string]interface{}{
+		"module":     modulePath,
+		"latest":     m.Latest,
+		"retract":    m.Retract,
+		"fetched_at": m.FetchedAt,
+	}
+	if version != "" {
+		rt, retracted := m.retracted(version)
+		resp["version"] = version
+		resp["retracted"] = retracted
+		if retracted {
+			resp["rationale"] = rt.Rationale
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetLicenses shows the licenses detected in a cached version and
+// whether they are allowed.
+func (a *Admin) handleGetLicenses(w http.ResponseWriter, r *http.Request) {
+	if !a.requireCache(w) || !a.requireLicenses(w) {
+		return
+	}
+	modulePath, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	if _, err := cacheKey(modulePath, version); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	meta, err := readMeta(r.Context(), a.proxy.cache, modulePath, version)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "version is not cached")
+		return
+	}
+	if err != nil {
+		a.logger.Error("Failed to read cache metadata", "module", modulePath, "version", version, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to read cache metadata")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"module":   modulePath,
+		"version":  version,
+		"licenses": meta.Licenses,
+	}
+	if meta.Licenses != nil {
+		err := a.proxy.fetcher.licenses.decide(modulePath, version, meta.Licenses)
+		resp["allowed"] = err == nil
+		if err != nil {
+			resp["reason"] = err.Error()
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handlePublish stores the module zip in the request body as a new version
+// of a hosted module.
+func (a *Admin) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if !a.requirePublish(w) {
+		return
+	}
+	modulePath, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	if _, err := cacheKey(modulePath, version); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	maxSize := a.cfg.Publish.MaxSize
+	if maxSize <= 0 {
+		maxSize = modzip.MaxZipFile
+	}
+	f, err := os.CreateTemp("", "toru-publish-*.zip")
+	if err != nil {
+		a.logger.Error("Failed to create temporary file", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	tmp := &tempFile{f}
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, maxSize)); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("zip is larger than %d bytes", maxSize))
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to read upload: %v", err))
+		return
+	}
+
+	sums, err := a.proxy.fetcher.publish(r.Context(), modulePath, version, f)
+	switch {
+	case errors.Is(err, errInvalidModule):
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, errDenied):
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, errVersionExists):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		a.logger.Error("Failed to publish module", "module", modulePath, "version", version, "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to publish module: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"module":  modulePath,
+		"version": version,
+		"sums":    sums,
+	})
+}
+
+// handleCheckVulns lists the known vulnerabilities of a module version.
+func (a *Admin) handleCheckVulns(w http.ResponseWriter, r *http.Request) {
+	if !a.requireVulnDB(w) {
+		return
+	}
+	modulePath, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	if _, err := cacheKey(modulePath, version); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	vulns := a.proxy.fetcher.vulns.lookup(modulePath, version)
+	if vulns == nil {
+		vulns = []*vuln{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"module":  modulePath,
+		"version": version,
+		"vulns":   vulns,
+	})
+}
+
+// handleRefreshVulnDB loads the vulnerability database from disk again.
+func (a *Admin) handleRefreshVulnDB(w http.ResponseWriter, r *http.Request) {
+	if !a.requireVulnDB(w) {
+		return
+	}
+	db := a.proxy.fetcher.vulns
+	if err := db.refresh(); err != nil {
+		a.logger.Error("Failed to refresh vulnerability database", "error", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	idx := db.current.Load()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries":   idx.entries,
+		"modules":   len(idx.modules),
+		"loaded_at": idx.loadedAt,
+	})
+}
+
+// purgeVersion deletes the files of a single version along with the module's
+// list and @latest entries, which may reference it.
+func (a *Admin) purgeVersion(r *http.Request, modulePath, version string) ([]string, error) {
+	key, err := cacheKey(modulePath, version)
+	if err != nil {
+		return nil, err
+	}
+	escapedPath, _ := module.EscapePath(modulePath)
+
+	names := []string{
+		key + ".info",
+		key + ".mod",
+		key + ".zip",
+		key + metaExt,
+		escapedPath + "/@v/list",
+		escapedPath + "/@latest",
+	}
+	return a.deleteAll(r, names)
+}
+
+// purgeModule deletes every cached entry of a module.
+func (a *Admin) purgeModule(r *http.Request, modulePath string) ([]string, error) {
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := a.proxy.cache.List(r.Context(), escapedPath+"/@")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return a.deleteAll(r, names)
+}
+
+// purgePattern deletes every cached entry of the modules whose path matches
+// the glob pattern. Published modules are skipped.
+func (a *Admin) purgePattern(r *http.Request, pattern string) ([]string, error) {
+	entries, err := a.proxy.cache.List(r.Context(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		escapedPath, _, ok := strings.Cut(e.Name, "/@")
+		if !ok {
+			continue
+		}
+		modulePath, err := module.UnescapePath(escapedPath)
+		if err != nil {
+			continue
+		}
+		if ok, _ := path.Match(pattern, modulePath); ok && !a.proxy.fetcher.hosted.owns(modulePath) {
+			names = append(names, e.Name)
+		}
+	}
+	return a.deleteAll(r, names)
+}
+
+func (a *Admin) deleteAll(r *http.Request, names []string) ([]string, error) {
+	purged := make([]string, 0, len(names))
+	for _, name := range names {
+		if err := a.proxy.cache.Delete(r.Context(), name); err != nil {
+			return purged, fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+		purged = append(purged, name)
+	}
+	return purged, nil
+}
+
+// requireCache writes an error and returns false when caching is disabled.
+func (a *Admin) requireCache(w http.ResponseWriter) bool {
+	if a.proxy.cache == nil {
+		writeError(w, http.StatusConflict, "caching is disabled")
+		return false
+	}
+	return true
+}
+
+// requirePolicy writes an error and returns false when the policy is disabled.
+func (a *Admin) requirePolicy(w http.ResponseWriter) bool {
+	if a.proxy.fetcher.policy == nil {
+		writeError(w, http.StatusConflict, "policy is disabled")
+		return false
+	}
+	return true
+}
+
+// requireRetractions writes an error and returns false when retractions are
+// disabled.
+func (a *Admin) requireRetractions(w http.ResponseWriter) bool {
+	if a.proxy.fetcher.retractions == nil {
+		writeError(w, http.StatusConflict, "retractions are disabled")
+		return false
+	}
+	return true
+}
+
+// requireLicenses writes an error and returns false when license detection
+// is disabled.
+func (a *Admin) requireLicenses(w http.ResponseWriter) bool {
+	if a.proxy.fetcher.licenses == nil {
+		writeError(w, http.StatusConflict, "license detection is disabled")
+		return false
+	}
+	return true
+}
+
+// requirePublish writes an error and returns false when publishing is
+// disabled.
+func (a *Admin) requirePublish(w http.ResponseWriter) bool {
+	if a.proxy.fetcher.hosted == nil {
+		writeError(w, http.StatusConflict, "publishing is disabled")
+		return false
+	}
+	return true
+}
+
+// requireVulnDB writes an error and returns false when the vulnerability
+// database is disabled.
+func (a *Admin) requireVulnDB(w http.ResponseWriter) bool {
+	if a.proxy.fetcher.vulns == nil {
+		writeError(w, http.StatusConflict, "vulnerability database is disabled")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
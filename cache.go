@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -15,14 +20,214 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/module"
 )
 
+// cacheStore extends goproxy.Cacher with the operations needed to inspect and
+// purge cached entries.
+type cacheStore interface {
+	goproxy.Cacher
+
+	// List returns all the entries whose name starts with prefix.
+	List(ctx context.Context, prefix string) ([]cacheEntry, error)
+
+	// Stat returns the entry for name. It returns fs.ErrNotExist if not found.
+	Stat(ctx context.Context, name string) (cacheEntry, error)
+
+	// Delete removes the entry for name. Deleting a missing entry is not an error.
+	Delete(ctx context.Context, name string) error
+}
+
+var (
+	_ = cacheStore(&diskCacher{})
+	_ = cacheStore(&s3Cacher{})
+)
+
+// cacheEntry describes a single object in the cache.
+type cacheEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// cacheMeta is stored alongside the module files of every downloaded version.
+// It records where the files came from so they can be audited later.
+type cacheMeta struct {
+	Module     string    `json:"module"`
+	Version    string    `json:"version"`
+	FetchedAt  time.Time `json:"fetched_at"`
+	SourcePath string    `json:"source_path"`
+	SourceRule string    `json:"source_rule,omitempty"`
+
+	// Sums are the h1: hashes of the served zip and go.mod.
+	Sums moduleSums `json:"sums"`
+
+	// Licenses are the SPDX IDs of the licenses detected in the zip. It
+	// is null if licenses weren't scanned.
+	Licenses []string `json:"licenses"`
+}
+
+// metaExt is the extension of the metadata object. goproxy refuses to serve
+// unknown extensions, so metadata is never exposed on the proxy endpoints.
+const metaExt = ".meta"
+
+func newCacheStore(cfg *Config) (cacheStore, error) {
+	switch cfg.Cache.Type {
+	case "s3":
+		return newS3Cacher(cfg)
+	case "disk":
+		return newDiskCacher(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported cache type: %s", cfg.Cache.Type)
+	}
+}
+
+// cacheKey returns the cache name prefix ("<path>/@v/<version>") for a module
+// version. Module files are stored under this prefix with their extension.
+func cacheKey(modulePath, version string) (string, error) {
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	return escapedPath + "/@v/" + escapedVersion, nil
+}
+
+// parseCacheName splits a cache name for a module file into the module path,
+// version and extension. Names that don't belong to a module version (lists,
+// @latest, sumdb objects) are reported as not ok.
+func parseCacheName(name string) (modulePath, version, ext string, ok bool) {
+	escapedPath, file, found := strings.Cut(name, "/@v/")
+	if !found || file == "list" {
+		return "", "", "", false
+	}
+	ext = path.Ext(file)
+	if ext == "" {
+		return "", "", "", false
+	}
+	var err error
+	if modulePath, err = module.UnescapePath(escapedPath); err != nil {
+		return "", "", "", false
+	}
+	if version, err = module.UnescapeVersion(strings.TrimSuffix(file, ext)); err != nil {
+		return "", "", "", false
+	}
+	return modulePath, version, ext, true
+}
+
+// readMeta loads the metadata of a module version from the cache.
+func readMeta(ctx context.Context, cache cacheStore, modulePath, version string) (*cacheMeta, error) {
+	key, err := cacheKey(modulePath, version)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := cache.Get(ctx, key+metaExt)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	meta := &cacheMeta{}
+	if err := json.NewDecoder(rc).Decode(meta); err != nil {
+		return nil, fmt.Errorf("failed to decode cache metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// writeMeta stores the metadata of a module version in the cache.
+func writeMeta(ctx context.Context, cache cacheStore, meta *cacheMeta) error {
+	key, err := cacheKey(meta.Module, meta.Version)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return cache.Put(ctx, key+metaExt, bytes.NewReader(b))
+}
+
+// diskCacher is a goproxy.DirCacher that can also list and delete entries.
+type diskCacher struct {
+	goproxy.DirCacher
+}
+
+func newDiskCacher(cfg *Config) *diskCacher {
+	return &diskCacher{DirCacher: goproxy.DirCacher(cfg.Cache.Disk.Path)}
+}
+
+func (dc *diskCacher) List(ctx context.Context, prefix string) ([]cacheEntry, error) {
+	root := string(dc.DirCacher)
+
+	// Walk from the deepest directory covered by the prefix to avoid
+	// scanning the whole cache.
+	start := root
+	if dir := path.Dir(prefix); prefix != "" && dir != "." {
+		start = filepath.Join(root, filepath.FromSlash(dir))
+	}
+
+	var entries []cacheEntry
+	err := filepath.WalkDir(start, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Skip directories and in-flight temporary files written by DirCacher.Put.
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, cacheEntry{Name: name, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (dc *diskCacher) Stat(ctx context.Context, name string) (cacheEntry, error) {
+	fi, err := os.Stat(filepath.Join(string(dc.DirCacher), filepath.FromSlash(name)))
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	return cacheEntry{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (dc *diskCacher) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(string(dc.DirCacher), filepath.FromSlash(name)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
 type s3Cacher struct {
 	client *s3.Client
 	bucket string
 }
 
-func newS3Cacher(cfg *Config) (goproxy.Cacher, error) {
+func newS3Cacher(cfg *Config) (*s3Cacher, error) {
 	ctx := context.Background()
 	awsCfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(cfg.Cache.S3.Region),
@@ -72,7 +277,7 @@ func (s3c *s3Cacher) Put(ctx context.Context, name string, content io.ReadSeeker
 	contentType := "application/octet-stream"
 	nameExt := filepath.Ext(name)
 	switch {
-	case nameExt == ".info", strings.HasSuffix(name, "/@latest"):
+	case nameExt == ".info", nameExt == metaExt, strings.HasSuffix(name, "/@latest"):
 		contentType = "application/json; charset=utf-8"
 	case nameExt == ".mod", strings.HasSuffix(name, "/@v/list"):
 		contentType = "text/plain; charset=utf-8"
@@ -96,3 +301,54 @@ func (s3c *s3Cacher) Put(ctx context.Context, name string, content io.ReadSeeker
 	})
 	return err
 }
+
+func (s3c *s3Cacher) List(ctx context.Context, prefix string) ([]cacheEntry, error) {
+	var entries []cacheEntry
+	paginator := s3.NewListObjectsV2Paginator(s3c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3c.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			entries = append(entries, cacheEntry{
+				Name:    aws.ToString(obj.Key),
+				Size:    aws.ToInt64(obj.Size),
+				ModTime: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+func (s3c *s3Cacher) Stat(ctx context.Context, name string) (cacheEntry, error) {
+	output, err := s3c.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		var nf *types.NotFound
+		if strings.Contains(err.Error(), "NotFound") || errors.As(err, &nf) {
+			return cacheEntry{}, fs.ErrNotExist
+		}
+		return cacheEntry{}, err
+	}
+
+	return cacheEntry{
+		Name:    name,
+		Size:    aws.ToInt64(output.ContentLength),
+		ModTime: aws.ToTime(output.LastModified),
+	}, nil
+}
+
+func (s3c *s3Cacher) Delete(ctx context.Context, name string) error {
+	_, err := s3c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(name),
+	})
+	return err
+}
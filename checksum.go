@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+)
+
+const (
+	defaultSumDB    = "sum.golang.org"
+	sumGolangOrgKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"
+)
+
+// ErrChecksumMismatch is returned when a downloaded module does not match the
+// hashes recorded in the checksum database.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// moduleSums holds the h1: hashes of a module version as they appear in go.sum.
+type moduleSums struct {
+	Zip string `json:"zip"`
+	Mod string `json:"mod"`
+}
+
+// checksumVerifier computes h1: hashes for downloaded modules and verifies
+// public ones against a checksum database.
+type checksumVerifier struct {
+	// client is nil when verification is disabled.
+	client *sumdb.Client
+
+	// private records private modules. It is nil when the private
+	// checksum database is disabled.
+	private *privateSumDB
+}
+
+func newChecksumVerifier(cfg *Config, rules ruleSet, cache cacheStore, transport http.RoundTripper, logger *slog.Logger) (*checksumVerifier, error) {
+	v := &checksumVerifier{}
+
+	if cfg.PrivateSumDB.Enabled {
+		private, err := newPrivateSumDB(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create private sumdb: %w", err)
+		}
+		v.private = private
+	}
+
+	if cfg.Checksum.Enabled {
+		ops, err := newSumdbOps(sumDB(cfg), cache, &http.Client{Transport: transport, Timeout: 30 * time.Second}, logger)
+		if err != nil {
+			return nil, err
+		}
+		v.client = sumdb.NewClient(ops)
+		v.client.SetGONOSUMDB(privatePatterns(cfg, rules))
+	}
+
+	return v, nil
+}
+
+// privatePatterns returns the module path patterns (GONOSUMDB syntax) of
+// private modules: the configured ones, the upstream GOPRIVATE patterns,
+// every vanity path we rewrite and the modules served without an upstream.
+// Private modules are never in a public checksum database.
+func privatePatterns(cfg *Config, rules ruleSet) string {
+	patterns := joinPatterns(noSumDB(cfg), cfg.Upstream.Private, strings.Join(rules.patterns(), ","))
+	if cfg.Publish.Enabled {
+		patterns = joinPatterns(patterns, cfg.Publish.Patterns)
+	}
+	for _, lm := range cfg.LocalModules {
+		patterns = joinPatterns(patterns, lm.Prefix)
+	}
+	return patterns
+}
+
+// sumDB returns the checksum database (GOSUMDB syntax) public modules are
+// checked against, both by the checksum verifier and by the go command for
+// direct fetches: the checksum one, else the upstream one. Empty means
+// sum.golang.org.
+func sumDB(cfg *Config) string {
+	if cfg.Checksum.SumDB != "" {
+		return cfg.Checksum.SumDB
+	}
+	return cfg.Upstream.SumDB
+}
+
+// noSumDB returns the configured module path patterns (GONOSUMDB syntax)
+// that are never checked against the checksum database, from both the
+// checksum and upstream settings.
+func noSumDB(cfg *Config) string {
+	return joinPatterns(cfg.Checksum.NoSumDB, cfg.Upstream.NoSumDB)
+}
+
+// computeSums computes the h1: hashes of the mod and zip files. Both readers
+// are rewound before returning.
+func computeSums(mod, zipFile io.ReadSeeker) (moduleSums, error) {
+	modHash, err := hashMod(mod)
+	if err != nil {
+		return moduleSums{}, fmt.Errorf("failed to hash go.mod: %w", err)
+	}
+	zipHash, err := hashZip(zipFile)
+	if err != nil {
+		return moduleSums{}, fmt.Errorf("failed to hash zip: %w", err)
+	}
+	return moduleSums{Zip: zipHash, Mod: modHash}, nil
+}
+
+// verify checks the sums of a module version against the checksum database.
+// Private modules are accepted as is. If the private checksum database is
+// enabled, every accepted version is then recorded in it, or checked against
+// its existing record.
+func (v *checksumVerifier) verify(path, version string, sums moduleSums) error {
+	if err := v.verifyPublic(path, version, sums); err != nil {
+		return err
+	}
+	if v.private != nil {
+		return v.private.record(path, version, sums)
+	}
+	return nil
+}
+
+func (v *checksumVerifier) verifyPublic(path, version string, sums moduleSums) error {
+	if v.client == nil {
+		return nil
+	}
+
+	for _, want := range []struct {
+		version string
+		hash    string
+	}{
+		{version, sums.Zip},
+		{version + "/go.mod", sums.Mod},
+	} {
+		lines, err := v.client.Lookup(path, want.version)
+		if err != nil {
+			if errors.Is(err, sumdb.ErrGONOSUMDB) {
+				return nil
+			}
+			return fmt.Errorf("checksum database lookup failed: %w", err)
+		}
+
+		line := fmt.Sprintf("%s %s %s", path, want.version, want.hash)
+		found := false
+		for _, l := range lines {
+			if l == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// Wrap fs.ErrNotExist so goproxy reports the reason to the
+			// go command instead of a generic server error.
+			return fmt.Errorf("%w: %w: %s@%s: downloaded %s", fs.ErrNotExist, ErrChecksumMismatch, path, want.version, want.hash)
+		}
+	}
+
+	return nil
+}
+
+// hashMod returns the h1: hash of a go.mod file as recorded in go.sum.
+func hashMod(mod io.ReadSeeker) (string, error) {
+	if _, err := mod.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(mod)
+	if err != nil {
+		return "", err
+	}
+	if _, err := mod.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return dirhash.DefaultHash([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+}
+
+// hashZip returns the h1: hash of a module zip as recorded in go.sum. It is
+// the in-memory equivalent of dirhash.HashZip.
+func hashZip(zipFile io.ReadSeeker) (string, error) {
+	size, err := zipFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	defer zipFile.Seek(0, io.SeekStart)
+
+	z, err := zip.NewReader(&readerAtFromReadSeeker{zipFile}, size)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		files  []string
+		zfiles = make(map[string]*zip.File)
+	)
+	for _, file := range z.File {
+		files = append(files, file.Name)
+		zfiles[file.Name] = file
+	}
+
+	return dirhash.DefaultHash(files, func(name string) (io.ReadCloser, error) {
+		f := zfiles[name]
+		if f == nil {
+			return nil, fmt.Errorf("file %q not found in zip", name)
+		}
+		return f.Open()
+	})
+}
+
+// sumdbOps implements sumdb.ClientOps. The latest signed tree is kept in
+// memory and verified records and tiles are stored in the cache, if enabled,
+// under the same names the sumdb proxy endpoints use.
+type sumdbOps struct {
+	name   string
+	key    string
+	url    *url.URL
+	client *http.Client
+	cache  cacheStore
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	latest []byte
+}
+
+// newSumdbOps parses a GOSUMDB-style value ("name", "key" or "key url").
+func newSumdbOps(gosumdb string, cache cacheStore, client *http.Client, logger *slog.Logger) (*sumdbOps, error) {
+	if gosumdb == "" {
+		gosumdb = defaultSumDB
+	}
+	parts := strings.Fields(gosumdb)
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid sumdb %q: too many fields", gosumdb)
+	}
+	if parts[0] == defaultSumDB {
+		parts[0] = sumGolangOrgKey
+	}
+
+	verifier, err := note.NewVerifier(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid sumdb key: %w", err)
+	}
+
+	rawURL := "https://" + verifier.Name()
+	if len(parts) == 2 {
+		rawURL = parts[1]
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sumdb url: %w", err)
+	}
+
+	return &sumdbOps{
+		name:   verifier.Name(),
+		key:    parts[0],
+		url:    u,
+		client: client,
+		cache:  cache,
+		logger: logger,
+	}, nil
+}
+
+func (o *sumdbOps) ReadRemote(path string) ([]byte, error) {
+	resp, err := o.client.Get(strings.TrimSuffix(o.url.String(), "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from checksum database: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (o *sumdbOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.key), nil
+	}
+	if strings.HasSuffix(file, "/latest") {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		// An empty result means an empty tree.
+		return o.latest, nil
+	}
+	return nil, fmt.Errorf("unknown config %s", file)
+}
+
+func (o *sumdbOps) WriteConfig(file string, old, new []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !bytes.Equal(o.latest, old) {
+		return sumdb.ErrWriteConflict
+	}
+	o.latest = new
+	return nil
+}
+
+func (o *sumdbOps) ReadCache(file string) ([]byte, error) {
+	if o.cache == nil {
+		return nil, fs.ErrNotExist
+	}
+	rc, err := o.cache.Get(context.Background(), "sumdb/"+file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (o *sumdbOps) WriteCache(file string, data []byte) {
+	if o.cache == nil {
+		return
+	}
+	o.cache.Put(context.Background(), "sumdb/"+file, bytes.NewReader(data))
+}
+
+func (o *sumdbOps) Log(msg string) {
+	o.logger.Debug("Checksum database", "sumdb", o.name, "message", msg)
+}
+
+func (o *sumdbOps) SecurityError(msg string) {
+	o.logger.Error("Checksum database security error", "sumdb", o.name, "message", msg)
+}
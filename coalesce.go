@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// flightGroup coalesces concurrent calls with the same key, so that callers
+// arriving while a call is in flight wait for it and share its result
+// instead of starting their own.
+type flightGroup[T any] struct {
+	// op labels the coalescing metrics.
+	op string
+
+	// share, if set, turns a successful result into n independent values,
+	// one per caller. It is needed for results that can't be used by more
+	// than one caller, such as readers. On error it must release v.
+	share func(v T, n int) ([]T, error)
+
+	// release, if set, releases a value of share whose caller stopped
+	// waiting for it.
+	release func(v T)
+
+	mu    sync.Mutex
+	calls map[string]*flight[T]
+}
+
+type flight[T any] struct {
+	done chan struct{}
+	dups int
+	vals []T
+	err  error
+}
+
+// do calls fn, or waits for the in-flight call with the same key.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flight[T])
+		}
+		if c, ok := g.calls[key]; ok {
+			c.dups++
+			i := c.dups
+			g.mu.Unlock()
+
+			metrics.GetOrCreateCounter(fmt.Sprintf("toru_coalesced_requests_total{op=%q}", g.op)).Inc()
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				// The call goes on for the other callers; this
+				// caller's value is released once it is ready.
+				if g.release != nil {
+					go func() {
+						<-c.done
+						if c.err == nil {
+							g.release(c.vals[i])
+						}
+					}()
+				}
+				var zero T
+				return zero, ctx.Err()
+			}
+
+			// The call failed because its caller went away; try again
+			// if this caller is still around.
+			if isContextErr(c.err) && ctx.Err() == nil {
+				continue
+			}
+			return c.vals[i], c.err
+		}
+
+		c := &flight[T]{done: make(chan struct{})}
+		g.calls[key] = c
+		g.mu.Unlock()
+
+		v, err := fn(ctx)
+
+		// No caller can join once the call is removed, so the number of
+		// callers is final.
+		g.mu.Lock()
+		delete(g.calls, key)
+		n := c.dups + 1
+		g.mu.Unlock()
+
+		c.vals, c.err = make([]T, n), err
+		switch {
+		case err != nil:
+		case n > 1 && g.share != nil:
+			vals, err := g.share(v, n)
+			if err != nil {
+				c.err = err
+				break
+			}
+			c.vals = vals
+		default:
+			for i := range c.vals {
+				c.vals[i] = v
+			}
+		}
+		close(c.done)
+		return c.vals[0], c.err
+	}
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// download is the result of fetcher.Download.
+type download struct {
+	info, mod, zip io.ReadSeekCloser
+}
+
+// releaseDownload closes the readers of a download.
+func releaseDownload(d download) {
+	d.info.Close()
+	d.mod.Close()
+	d.zip.Close()
+}
+
+// shareDownload gives each caller its own readers of a downloaded module
+// version. The info and mod files are small and kept in memory. Zips are
+// kept in memory if they already are, otherwise they are spooled to a
+// temporary file removed once every caller has closed its copy.
+func shareDownload(d download, n int) ([]download, error) {
+	defer releaseDownload(d)
+
+	for _, r := range []io.Seeker{d.info, d.mod, d.zip} {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	info, err := io.ReadAll(d.info)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := io.ReadAll(d.mod)
+	if err != nil {
+		return nil, err
+	}
+
+	zips := make([]io.ReadSeekCloser, n)
+	if _, ok := d.zip.(*readSeekCloser); ok {
+		zip, err := io.ReadAll(d.zip)
+		if err != nil {
+			return nil, err
+		}
+		for i := range zips {
+			zips[i] = &readSeekCloser{bytes.NewReader(zip)}
+		}
+	} else if zips, err = spoolShared(d.zip, n); err != nil {
+		return nil, err
+	}
+
+	ds := make([]download, n)
+	for i := range ds {
+		ds[i] = download{
+			info: &readSeekCloser{bytes.NewReader(info)},
+			mod:  &readSeekCloser{bytes.NewReader(mod)},
+			zip:  zips[i],
+		}
+	}
+	return ds, nil
+}
+
+// spoolShared copies r to a temporary file and opens it n times. The file is
+// removed when the last copy is closed.
+func spoolShared(r io.Reader, n int) ([]io.ReadSeekCloser, error) {
+	f, err := os.CreateTemp("", "toru-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	name := f.Name()
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+
+	refs := &atomic.Int32{}
+	refs.Store(int32(n))
+	files := make([]io.ReadSeekCloser, 0, n)
+	for i := 0; i < n; i++ {
+		f, err := os.Open(name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			os.Remove(name)
+			return nil, err
+		}
+		files = append(files, &sharedFile{File: f, refs: refs})
+	}
+	return files, nil
+}
+
+// sharedFile is one of several handles of a temporary file. The file is
+// removed when the last handle is closed.
+type sharedFile struct {
+	*os.File
+	refs *atomic.Int32
+	once sync.Once
+}
+
+func (f *sharedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() {
+		if f.refs.Add(-1) == 0 {
+			os.Remove(f.Name())
+		}
+	})
+	return err
+}
+
+// coalescingCache is a cacheStore that coalesces concurrent writes of the
+// same module file, such as the ones made by every request sharing a
+// coalesced download. Only immutable files are coalesced: concurrent writes
+// of the others, such as version lists or the latest signed tree of a
+// checksum database, may have different contents.
+type coalescingCache struct {
+	cacheStore
+	puts flightGroup[struct{}]
+}
+
+func newCoalescingCache(c cacheStore) *coalescingCache {
+	return &coalescingCache{cacheStore: c, puts: flightGroup[struct{}]{op: "cache_put"}}
+}
+
+func (c *coalescingCache) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	if _, _, ext, ok := parseCacheName(name); !ok || (ext != ".info" && ext != ".mod" && ext != ".zip") {
+		return c.cacheStore.Put(ctx, name, content)
+	}
+	_, err := c.puts.do(ctx, name, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, c.cacheStore.Put(ctx, name, content)
+	})
+	return err
+}
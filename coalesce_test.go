@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goproxy/goproxy"
+)
+
+func TestFlightGroupWaiterCanceled(t *testing.T) {
+	var released atomic.Int32
+	g := flightGroup[*int]{
+		op: "test",
+		share: func(v *int, n int) ([]*int, error) {
+			vals := make([]*int, n)
+			for i := range vals {
+				vals[i] = new(int)
+			}
+			return vals, nil
+		},
+		release: func(*int) { released.Add(1) },
+	}
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	leader := make(chan error)
+	go func() {
+		_, err := g.do(context.Background(), "k", func(context.Context) (*int, error) {
+			close(started)
+			<-finish
+			return new(int), nil
+		})
+		leader <- err
+	}()
+	<-started
+
+	// A waiter whose context is done returns right away, without waiting
+	// for the call.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.do(ctx, "k", func(context.Context) (*int, error) {
+		t.Error("the waiter started its own call")
+		return nil, nil
+	}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiter error = %v, want deadline exceeded", err)
+	}
+
+	close(finish)
+	if err := <-leader; err != nil {
+		t.Fatalf("leader error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for released.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := released.Load(); n != 1 {
+		t.Errorf("released values = %d, want 1", n)
+	}
+}
+
+func TestCoalescingCachePut(t *testing.T) {
+	tests := []struct {
+		name      string
+		coalesced bool
+	}{
+		{"example.com/m/@v/v1.0.0.info", true},
+		{"example.com/m/@v/v1.0.0.mod", true},
+		{"example.com/m/@v/v1.0.0.zip", true},
+		{"example.com/m/@v/v1.0.0.meta", false},
+		{"example.com/m/@v/list", false},
+		{"example.com/m/@latest", false},
+		{"sumdb/sum.golang.org/latest", false},
+	}
+	for _, tt := range tests {
+		c := newCoalescingCache(&diskCacher{DirCacher: goproxy.DirCacher(t.TempDir())})
+		// A put of the same name is in flight: coalesced puts wait for
+		// it, and give up as their context is done.
+		c.puts.calls = map[string]*flight[struct{}]{tt.name: {done: make(chan struct{})}}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := c.Put(ctx, tt.name, strings.NewReader("content"))
+		if coalesced := errors.Is(err, context.Canceled); coalesced != tt.coalesced {
+			t.Errorf("Put(%s) coalesced = %v, want %v (error %v)", tt.name, coalesced, tt.coalesced, err)
+		}
+	}
+}
@@ -36,10 +36,167 @@ type Config struct {
 		} `koanf:"disk"`
 	} `koanf:"cache"`
 
-	RewriteRules []struct {
-		VanityPath string `koanf:"vanity_path"`
-		TargetPath string `koanf:"target_path"`
-	} `koanf:"rewrite_rules"`
+	RewriteRules []RewriteRule `koanf:"rewrite_rules"`
+
+	Upstream struct {
+		// Proxy is the GOPROXY list modules are fetched from. Entries are
+		// separated by ',' (fall back on 404 and 410 only) or '|' (fall
+		// back on any error). Defaults to "https://proxy.golang.org,direct".
+		Proxy string `koanf:"proxy"`
+
+		// SumDB is the GOSUMDB used by direct fetches, unless
+		// Checksum.SumDB is set: it takes precedence. Empty uses the go
+		// command's default.
+		SumDB string `koanf:"sumdb"`
+
+		// NoSumDB, Private and Insecure are comma-separated module path
+		// patterns for GONOSUMDB, GOPRIVATE and GOINSECURE. Vanity paths
+		// of rewrite rules are always private. NoSumDB is merged with
+		// Checksum.NoSumDB, and both apply to direct fetches and to
+		// checksum verification.
+		NoSumDB  string `koanf:"nosumdb"`
+		Private  string `koanf:"private"`
+		Insecure string `koanf:"insecure"`
+
+		// VCS is the GOVCS setting for direct fetches.
+		VCS string `koanf:"vcs"`
+
+		Limits struct {
+			// MaxConcurrent is the maximum number of concurrent
+			// upstream fetches. 0 means no limit.
+			MaxConcurrent int `koanf:"max_concurrent"`
+
+			// MaxPerHost is the maximum number of concurrent fetches
+			// per upstream host: the proxy host, or the module's host
+			// for direct fetches. 0 means no limit.
+			MaxPerHost int `koanf:"max_per_host"`
+
+			// Hosts overrides MaxPerHost for specific hosts.
+			Hosts map[string]int `koanf:"hosts"`
+
+			// MaxQueue is the maximum number of fetches waiting for a
+			// slot. Fetches beyond it fail immediately with 503. 0
+			// means no limit.
+			MaxQueue int `koanf:"max_queue"`
+
+			// QueueTimeout is the maximum time a fetch waits for a slot
+			// before failing with 503. 0 means no timeout.
+			QueueTimeout time.Duration `koanf:"queue_timeout"`
+
+			// RetryAfter is the Retry-After sent with 503 responses.
+			// Defaults to 5s.
+			RetryAfter time.Duration `koanf:"retry_after"`
+		} `koanf:"limits"`
+
+		Retry struct {
+			// MaxAttempts is the number of attempts of a fetch that
+			// fails with a transient error (timeout, 5xx, network).
+			// Defaults to 3.
+			MaxAttempts int `koanf:"max_attempts"`
+
+			// BaseDelay and MaxDelay bound the jittered exponential
+			// backoff between attempts. Default to 200ms and 5s.
+			BaseDelay time.Duration `koanf:"base_delay"`
+			MaxDelay  time.Duration `koanf:"max_delay"`
+
+			// BreakerThreshold is the number of consecutive transient
+			// failures after which an upstream host's circuit breaker
+			// opens. Defaults to 5.
+			BreakerThreshold int `koanf:"breaker_threshold"`
+
+			// BreakerOpenDuration is how long an open breaker fails
+			// fetches before letting a probe through. Defaults to 30s.
+			BreakerOpenDuration time.Duration `koanf:"breaker_open_duration"`
+		} `koanf:"retry"`
+	} `koanf:"upstream"`
+
+	// Routes send matching modules to a specific upstream instead of the
+	// default one. The first matching route wins.
+	Routes []Route `koanf:"routes"`
+
+	// LocalModules serve the modules under a path prefix from a local
+	// directory or git repository. They take precedence over Routes.
+	LocalModules []LocalModule `koanf:"local_modules"`
+
+	Checksum struct {
+		// Enabled is a flag to verify downloaded modules against a
+		// checksum database before they are cached.
+		Enabled bool `koanf:"enabled"`
+
+		// SumDB is the checksum database in GOSUMDB syntax: a name, a
+		// verifier key, or a key followed by a URL. Empty uses
+		// Upstream.SumDB, else sum.golang.org.
+		SumDB string `koanf:"sumdb"`
+
+		// NoSumDB is a comma-separated list of module path prefix
+		// patterns (GONOSUMDB syntax) that are not verified. It is
+		// merged with Upstream.NoSumDB. Vanity paths of rewrite rules
+		// are always skipped.
+		NoSumDB string `koanf:"nosumdb"`
+	} `koanf:"checksum"`
+
+	PrivateSumDB struct {
+		// Enabled is a flag to run a checksum database for private
+		// modules.
+		Enabled bool `koanf:"enabled"`
+
+		// Name of the checksum database, e.g. "sum.corp.com". It is
+		// served under /sumdb/<name>/.
+		Name string `koanf:"name"`
+
+		// Path is the directory where the log and the signer key are
+		// stored.
+		Path string `koanf:"path"`
+
+		// Key is the signer key. If empty, a key is generated and stored
+		// in Path on first start.
+		Key string `koanf:"key"`
+	} `koanf:"private_sumdb"`
+
+	SumDBProxy struct {
+		// Enabled is a flag to proxy public checksum databases under
+		// /sumdb/<name>/, so that the go command verifies modules
+		// through GOPROXY. Tiles and lookups are cached for good.
+		Enabled bool `koanf:"enabled"`
+
+		// SumDBs lists the proxied checksum databases, as a name
+		// optionally followed by a URL, e.g. "sum.golang.org" or
+		// "sum.golang.org https://sum.golang.google.cn". Defaults to
+		// sum.golang.org.
+		SumDBs []string `koanf:"sumdbs"`
+
+		// LatestTTL is how long the latest signed tree of a database
+		// is served before it is fetched again. Defaults to 10m.
+		LatestTTL time.Duration `koanf:"latest_ttl"`
+	} `koanf:"sumdb_proxy"`
+
+	GoGet struct {
+		// Enabled is a flag to answer ?go-get=1 requests for vanity paths
+		// with go-import and go-source meta tags.
+		Enabled bool `koanf:"enabled"`
+
+		// VCS is the version control system of the target repositories.
+		// Defaults to "git".
+		VCS string `koanf:"vcs"`
+
+		// Scheme is the URL scheme used to reach the target repositories.
+		// Defaults to "https".
+		Scheme string `koanf:"scheme"`
+
+		// Host, if set, replaces the host of the target path in repository
+		// URLs, e.g. when repositories are cloned from a different host.
+		Host string `koanf:"host"`
+
+		// Branch is the branch linked to by go-source tags. Defaults to
+		// "master".
+		Branch string `koanf:"branch"`
+
+		// Forge decides the URLs of the directory and file pages in
+		// go-source tags: "github", "gitlab" or "gitea". Empty uses
+		// GitLab's for hosts with "gitlab" in their name and GitHub's
+		// otherwise.
+		Forge string `koanf:"forge"`
+	} `koanf:"go_get"`
 
 	Auth struct {
 		// Enabled is a flag to enable or disable the auth module.
@@ -48,6 +205,205 @@ type Config struct {
 		// Modules is a list of auth modules.
 		Modules []AuthModule `koanf:"modules"`
 	} `koanf:"auth"`
+
+	Policy struct {
+		// Enabled is a flag to enforce the module policy.
+		Enabled bool `koanf:"enabled"`
+
+		// File is the TOML file with the policy rules. It is reloaded on
+		// SIGHUP and through the admin API.
+		File string `koanf:"file"`
+	} `koanf:"policy"`
+
+	Cooldown struct {
+		// MinAge is how long after their publication versions are
+		// served. Younger versions are left out of lists and @latest,
+		// and their downloads are refused. Zero disables the cooldown.
+		MinAge time.Duration `koanf:"min_age"`
+
+		// Overrides set the minimum age of some modules, such as
+		// private ones. The first matching override wins.
+		Overrides []CooldownOverride `koanf:"overrides"`
+	} `koanf:"cooldown"`
+
+	Retractions struct {
+		// Enabled is a flag to read the retract directives of modules,
+		// from the go.mod of their latest version, and to count
+		// downloads of retracted versions.
+		Enabled bool `koanf:"enabled"`
+
+		// Hide leaves retracted versions out of version lists, so that
+		// @latest resolves to the latest version that isn't retracted.
+		Hide bool `koanf:"hide"`
+
+		// TTL is how long the retractions of a module are kept before
+		// they are read again. Defaults to 1h.
+		TTL time.Duration `koanf:"ttl"`
+	} `koanf:"retractions"`
+
+	Licenses struct {
+		// Enabled is a flag to detect the licenses of module zips when
+		// they are first downloaded and record them in the cache
+		// metadata.
+		Enabled bool `koanf:"enabled"`
+
+		// Allowed lists the SPDX IDs of allowed licenses. Versions with
+		// any other license are refused. Empty allows every license.
+		Allowed []string `koanf:"allowed"`
+
+		// BlockUnknown also refuses versions without a recognized
+		// license. It requires Allowed.
+		BlockUnknown bool `koanf:"block_unknown"`
+
+		// Exempt is a comma-separated list of module path patterns
+		// (GOPRIVATE syntax) whose licenses aren't checked, such as
+		// internal modules.
+		Exempt string `koanf:"exempt"`
+	} `koanf:"licenses"`
+
+	VulnDB struct {
+		// Enabled is a flag to check served versions against an offline
+		// vulnerability database.
+		Enabled bool `koanf:"enabled"`
+
+		// Path is a directory of OSV JSON entries, such as a mirror of
+		// vuln.go.dev. It is loaded again through the admin API.
+		Path string `koanf:"path"`
+
+		// Mode is "warn" to report vulnerable versions in a response
+		// header, "block" to also refuse their zips and queries, or
+		// "hide" to leave them out of version lists and queries.
+		// Defaults to "warn".
+		Mode string `koanf:"mode"`
+
+		// MinSeverity is the lowest severity (low, moderate, high or
+		// critical) that blocks or hides a version. Empty counts every
+		// vulnerability, including those without a severity.
+		MinSeverity string `koanf:"min_severity"`
+
+		// Ignore lists vulnerability IDs that are not reported.
+		Ignore []string `koanf:"ignore"`
+	} `koanf:"vulndb"`
+
+	Toolchain struct {
+		// Versions lists the Go versions (path.Match patterns such as
+		// "go1.23.*") of the toolchains served from the
+		// golang.org/toolchain module, which the go command downloads
+		// when GOTOOLCHAIN selects a newer release. Empty serves all.
+		Versions []string `koanf:"versions"`
+
+		// Platforms lists the platforms (patterns such as "linux-*") of
+		// the toolchains served. Empty serves all.
+		Platforms []string `koanf:"platforms"`
+
+		// Prewarm lists toolchains, such as "go1.23.4.linux-amd64",
+		// downloaded into the cache at startup. It requires the cache.
+		Prewarm []string `koanf:"prewarm"`
+	} `koanf:"toolchain"`
+
+	Mirror struct {
+		// Enabled is a flag to download new versions of Modules into
+		// the cache on a schedule, rather than when first requested.
+		// It requires the cache.
+		Enabled bool `koanf:"enabled"`
+
+		// Modules lists the module paths to mirror. A path ending in
+		// "/..." matches the modules at or under it that are already
+		// in the cache.
+		Modules []string `koanf:"modules"`
+
+		// Interval is the time between runs. Defaults to 1h.
+		Interval time.Duration `koanf:"interval"`
+
+		// Jitter is the largest random delay added before each run.
+		Jitter time.Duration `koanf:"jitter"`
+
+		// Concurrency is the number of versions downloaded at once.
+		// Defaults to 4.
+		Concurrency int `koanf:"concurrency"`
+
+		// MaxVersions mirrors only the newest versions of each module.
+		// 0 mirrors all of them.
+		MaxVersions int `koanf:"max_versions"`
+	} `koanf:"mirror"`
+
+	Publish struct {
+		// Enabled is a flag to accept modules published through the
+		// admin API. It requires the cache.
+		Enabled bool `koanf:"enabled"`
+
+		// Patterns is a comma-separated list of module path patterns
+		// (GOPRIVATE syntax) of the modules that can be published.
+		// They are served from the cache only and never fetched from
+		// upstream.
+		Patterns string `koanf:"patterns"`
+
+		// MaxSize is the largest accepted zip, in bytes. Defaults to
+		// the 500 MiB limit of the go command.
+		MaxSize int64 `koanf:"max_size"`
+	} `koanf:"publish"`
+
+	Admin struct {
+		// Enabled is a flag to enable or disable the admin API.
+		Enabled bool `koanf:"enabled"`
+
+		// Address is the listen address of the admin API. It must be
+		// different from the proxy address.
+		Address string `koanf:"address"`
+
+		// Username and Password are the basic auth credentials required
+		// for every admin API request.
+		Username string `koanf:"username"`
+		Password string `koanf:"password"`
+	} `koanf:"admin"`
+}
+
+// RewriteRule maps a vanity module path to the path it is fetched from.
+// Exactly one of VanityPath, VanityGlob or VanityRegex must be set.
+type RewriteRule struct {
+	// VanityPath is a literal vanity path prefix.
+	VanityPath string `koanf:"vanity_path"`
+
+	// VanityGlob is a vanity path prefix where each '*' matches a single
+	// path element, captured as ${1}, ${2} and so on.
+	VanityGlob string `koanf:"vanity_glob"`
+
+	// VanityRegex is a regular expression matching a vanity path prefix.
+	// Capture groups can be referenced in TargetPath as ${name}. It may
+	// only consist of literals and capture groups, all used in TargetPath,
+	// so that target paths can be mapped back.
+	VanityRegex string `koanf:"vanity_regex"`
+
+	// TargetPath is the path the vanity prefix is rewritten to. For glob
+	// and regex rules it is a template expanded with the captured groups.
+	TargetPath string `koanf:"target_path"`
+
+	// RewriteImports also rewrites import paths covered by rewrite rules
+	// in the Go source files of modules matched by this rule.
+	RewriteImports bool `koanf:"rewrite_imports"`
+}
+
+// String returns a human-readable form of the rule for logs and metadata.
+func (r RewriteRule) String() string {
+	vanity := r.VanityPath
+	switch {
+	case r.VanityGlob != "":
+		vanity = r.VanityGlob
+	case r.VanityRegex != "":
+		vanity = r.VanityRegex
+	}
+	return vanity + " => " + r.TargetPath
+}
+
+// Route maps module paths to the upstream they are fetched from.
+type Route struct {
+	// Pattern is a comma-separated list of module path prefix patterns
+	// (GOPRIVATE syntax), matched against the path after rewriting.
+	Pattern string `koanf:"pattern"`
+
+	// Upstream is a GOPROXY list (usually a single proxy URL), "direct"
+	// to fetch from the VCS, or "off" to block the modules.
+	Upstream string `koanf:"upstream"`
 }
 
 // AuthModule represents an auth module configuration.
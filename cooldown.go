@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// CooldownOverride sets the minimum age of the modules matching a pattern.
+type CooldownOverride struct {
+	// Pattern is a comma-separated list of module path patterns in
+	// GOPRIVATE syntax, matched against the requested path.
+	Pattern string `koanf:"pattern"`
+
+	// MinAge replaces the default minimum age. Zero disables the
+	// cooldown for the modules.
+	MinAge time.Duration `koanf:"min_age"`
+}
+
+// cooldown holds back versions published less than a minimum age ago, so
+// that a compromised release has time to be noticed and pulled before it is
+// served.
+type cooldown struct {
+	minAge    time.Duration
+	overrides []CooldownOverride
+
+	// times caches the publication time of versions, which never changes.
+	times sync.Map
+}
+
+// newCooldown returns nil if no module has a minimum age.
+func newCooldown(cfg *Config) (*cooldown, error) {
+	c := cfg.Cooldown
+	enabled := c.MinAge > 0
+	if c.MinAge < 0 {
+		return nil, fmt.Errorf("invalid cooldown min_age: can't be negative")
+	}
+	for i, o := range c.Overrides {
+		if o.Pattern == "" {
+			return nil, fmt.Errorf("cooldown override %d: missing pattern", i+1)
+		}
+		if err := validatePatterns(o.Pattern); err != nil {
+			return nil, fmt.Errorf("cooldown override %d: %w", i+1, err)
+		}
+		if o.MinAge < 0 {
+			return nil, fmt.Errorf("cooldown override %d: min_age can't be negative", i+1)
+		}
+		enabled = enabled || o.MinAge > 0
+	}
+	if !enabled {
+		return nil, nil
+	}
+	return &cooldown{minAge: c.MinAge, overrides: c.Overrides}, nil
+}
+
+// minAgeOf returns the minimum age of the versions of a module. The first
+// matching override wins.
+func (c *cooldown) minAgeOf(path string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	for _, o := range c.overrides {
+		if module.MatchPrefixPatterns(o.Pattern, path) {
+			return o.MinAge
+		}
+	}
+	return c.minAge
+}
+
+// tooNewError is the deniedError of a version younger than the minimum age
+// of its module.
+type tooNewError struct {
+	deniedError
+}
+
+// tooNew returns a tooNewError if a version published at t is younger than
+// the minimum age of its module. Versions without a time are let through.
+func (c *cooldown) tooNew(path, version string, t time.Time) error {
+	minAge := c.minAgeOf(path)
+	if minAge == 0 || t.IsZero() {
+		return nil
+	}
+	age := time.Since(t)
+	if age >= minAge {
+		return nil
+	}
+	return &tooNewError{deniedError{fmt.Sprintf("%s@%s was published %s ago, less than the minimum age of %s",
+		path, version, age.Round(time.Minute), minAge)}}
+}
+
+// versionTime returns the publication time of a module version, from the
+// cache if the version is cached and from upstream otherwise.
+func (f *fetcher) versionTime(ctx context.Context, path, version string) (time.Time, error) {
+	key := path + "@" + version
+	if t, ok := f.cooldown.times.Load(key); ok {
+		return t.(time.Time), nil
+	}
+
+	t, err := f.cachedTime(ctx, path, version)
+	if errors.Is(err, fs.ErrNotExist) {
+		var r queryResult
+		r, err = f.queries.do(ctx, key, func(ctx context.Context) (queryResult, error) {
+			version, t, err := f.query(ctx, path, version)
+			return queryResult{version, t}, err
+		})
+		t = r.time
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	f.cooldown.times.Store(key, t)
+	return t, nil
+}
+
+// cachedTime reads the time of a version from its cached .info file.
+func (f *fetcher) cachedTime(ctx context.Context, path, version string) (time.Time, error) {
+	if f.cache == nil {
+		return time.Time{}, fs.ErrNotExist
+	}
+	key, err := cacheKey(path, version)
+	if err != nil {
+		return time.Time{}, err
+	}
+	rc, err := f.cache.Get(ctx, key+".info")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, t, err := parseInfo(b)
+	return t, err
+}
+
+// checkAge returns a deniedError if a version is younger than the minimum
+// age of its module.
+func (f *fetcher) checkAge(ctx context.Context, path, version string) error {
+	if f.cooldown.minAgeOf(path) == 0 {
+		return nil
+	}
+	t, err := f.versionTime(ctx, path, version)
+	if err != nil {
+		return err
+	}
+	err = f.cooldown.tooNew(path, version, t)
+	countTooNew(err)
+	return err
+}
+
+// countTooNew counts a download or query refused because the version is
+// younger than the minimum age.
+func countTooNew(err error) {
+	var tooNew *tooNewError
+	if errors.As(err, &tooNew) {
+		cooldownRefusedTotal.Inc()
+	}
+}
+
+// filterAge leaves out the versions of a module that are younger than its
+// minimum age. The versions of each major.minor line are checked from the
+// highest down to the first one old enough: the rest of the line is assumed
+// to be older, which saves looking up the time of every version. Lines are
+// checked separately, as a backport to an older line can be younger than a
+// newer line. Downloads of every version are still checked.
+func (f *fetcher) filterAge(ctx context.Context, path string, versions []string) []string {
+	if f.cooldown.minAgeOf(path) == 0 {
+		return versions
+	}
+
+	sorted := slices.Clone(versions)
+	semver.Sort(sorted)
+	hidden := make(map[string]bool)
+	// aged holds the major.minor lines with a version old enough.
+	aged := make(map[string]bool)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		v := sorted[i]
+		line := semver.MajorMinor(v)
+		if aged[line] {
+			continue
+		}
+		t, err := f.versionTime(ctx, path, v)
+		if err != nil {
+			f.logger.Warn("Failed to get version time, hiding it", "module", path, "version", v, "error", err)
+			hidden[v] = true
+			continue
+		}
+		if f.cooldown.tooNew(path, v, t) == nil {
+			aged[line] = true
+			continue
+		}
+		hidden[v] = true
+	}
+
+	shown := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if !hidden[v] {
+			shown = append(shown, v)
+		}
+	}
+	return shown
+}
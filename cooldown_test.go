@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFilterAgeBackports(t *testing.T) {
+	f := &fetcher{
+		cooldown: &cooldown{minAge: 24 * time.Hour},
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	now := time.Now()
+	for v, age := range map[string]time.Duration{
+		"v1.9.3": 90 * 24 * time.Hour,
+		"v1.9.4": 60 * 24 * time.Hour,
+		// A backport published after the newer line.
+		"v1.9.5": time.Hour,
+		"v2.0.0": 30 * 24 * time.Hour,
+		"v2.0.1": time.Hour,
+	} {
+		f.cooldown.times.Store("example.com/m@"+v, now.Add(-age))
+	}
+
+	got := f.filterAge(context.Background(), "example.com/m", []string{"v1.9.3", "v1.9.4", "v1.9.5", "v2.0.0", "v2.0.1"})
+	want := []string{"v1.9.3", "v1.9.4", "v2.0.0"}
+	if !slices.Equal(got, want) {
+		t.Errorf("filterAge = %v, want %v", got, want)
+	}
+}
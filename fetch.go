@@ -4,57 +4,241 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"os"
+	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
 )
 
 type fetcher struct {
-	upstream *goproxy.GoFetcher
+	upstream *router
 	cfg      *Config
+	rules    ruleSet
 	logger   *slog.Logger
+
+	// cache is used to record metadata about downloaded versions. It is
+	// nil when caching is disabled.
+	cache cacheStore
+
+	// checksums hashes and verifies downloaded modules.
+	checksums *checksumVerifier
+
+	// policy denies modules and versions. It is nil when disabled.
+	policy *policy
+
+	// vulns reports vulnerable versions. It is nil when disabled.
+	vulns *vulnDB
+
+	// cooldown holds back young versions. It is nil when disabled.
+	cooldown *cooldown
+
+	// retractions reads retracted versions. It is nil when disabled.
+	retractions *retractions
+
+	// licenses detects and checks licenses. It is nil when disabled.
+	licenses *licenses
+
+	// toolchains restricts the Go toolchains served. It is nil when
+	// disabled.
+	toolchains *toolchains
+
+	// hosted serves published modules. It is nil when disabled.
+	hosted *hosted
+
+	// Concurrent identical calls share one upstream fetch.
+	queries   flightGroup[queryResult]
+	lists     flightGroup[[]string]
+	downloads flightGroup[download]
+}
+
+// queryResult is the result of fetcher.Query.
+type queryResult struct {
+	version string
+	time    time.Time
 }
 
-func newFetcher(cfg *Config, logger *slog.Logger) (*fetcher, error) {
-	vanityPaths := make([]string, len(cfg.RewriteRules))
-	for i, rule := range cfg.RewriteRules {
-		vanityPaths[i] = rule.VanityPath
+func newFetcher(cfg *Config, cache cacheStore, transport http.RoundTripper, logger *slog.Logger) (*fetcher, error) {
+	rules, err := compileRules(cfg.RewriteRules)
+	if err != nil {
+		return nil, err
+	}
+
+	checksums, err := newChecksumVerifier(cfg, rules, cache, transport, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checksum verifier: %w", err)
+	}
+
+	env, err := upstreamEnv(cfg, rules)
+	if err != nil {
+		return nil, err
+	}
+	logUpstream(env, logger)
+
+	hosted, err := newHosted(cfg, cache, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream, err := newRouter(cfg, env, transport, hosted, logger)
+	if err != nil {
+		return nil, err
 	}
-	vanityPathsStr := strings.Join(vanityPaths, ",")
 
-	return &fetcher{
-		upstream: &goproxy.GoFetcher{
-			Env: append(os.Environ(),
-				"GOPROXY=https://proxy.golang.org,direct",
-				fmt.Sprintf("GOPRIVATE=%s", vanityPathsStr),
-				fmt.Sprintf("GONOPROXY=%s", vanityPathsStr),
-			),
-		},
-		cfg:    cfg,
-		logger: logger,
-	}, nil
+	var pol *policy
+	if cfg.Policy.Enabled {
+		if pol, err = newPolicy(cfg.Policy.File, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	cool, err := newCooldown(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	retractions, err := newRetractions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	lic, err := newLicenses(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	toolchains, err := newToolchains(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var vulns *vulnDB
+	if cfg.VulnDB.Enabled {
+		if vulns, err = newVulnDB(cfg, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &fetcher{
+		upstream:    upstream,
+		cfg:         cfg,
+		rules:       rules,
+		logger:      logger,
+		cache:       cache,
+		checksums:   checksums,
+		policy:      pol,
+		vulns:       vulns,
+		cooldown:    cool,
+		retractions: retractions,
+		licenses:    lic,
+		toolchains:  toolchains,
+		hosted:      hosted,
+		queries:     flightGroup[queryResult]{op: "query"},
+		lists:       flightGroup[[]string]{op: "list"},
+		downloads:   flightGroup[download]{op: "download", share: shareDownload, release: releaseDownload},
+	}
+
+	// Let the private checksum database fetch versions it is asked about
+	// before they were ever served.
+	if checksums.private != nil {
+		checksums.private.download = func(ctx context.Context, path, version string) error {
+			info, mod, zip, err := f.Download(ctx, path, version)
+			if err != nil {
+				return err
+			}
+			info.Close()
+			mod.Close()
+			zip.Close()
+			return nil
+		}
+	}
+
+	return f, nil
 }
 
+// rewrite maps a vanity path to the path it is fetched from.
 func (f *fetcher) rewrite(path string) string {
-	for _, rule := range f.cfg.RewriteRules {
-		if strings.HasPrefix(path, rule.VanityPath) {
-			f.logger.Debug("Rewriting path",
-				"original", path,
-				"vanity", rule.VanityPath,
-				"target", rule.TargetPath,
-			)
-			return strings.Replace(path, rule.VanityPath, rule.TargetPath, 1)
+	target, rule, ok := f.rules.toTarget(path)
+	if !ok {
+		return path
+	}
+	f.logger.Debug("Rewriting path",
+		"original", path,
+		"rule", rule.String(),
+		"target", target,
+	)
+	return target
+}
+
+func (f *fetcher) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	r, err := f.queries.do(ctx, path+"@"+query, func(ctx context.Context) (queryResult, error) {
+		version, t, err := f.query(ctx, path, query)
+		return queryResult{version, t}, err
+	})
+	// @latest falls back to the latest version that isn't retracted, then
+	// to the latest version that is allowed.
+	if err == nil && query == "latest" {
+		r.version, r.time, err = f.latestUnretracted(ctx, path, r.version, r.time)
+	}
+	if err == nil {
+		err = f.checkQueried(ctx, path, r.version, r.time)
+		if errors.Is(err, errDenied) && query == "latest" {
+			r.version, r.time, err = f.latestAllowed(ctx, path, err)
+			if err == nil {
+				err = f.checkQueried(ctx, path, r.version, r.time)
+			}
 		}
+		countTooNew(err)
+	}
+	markUnavailable(ctx, err)
+	markDenied(ctx, err)
+	return r.version, r.time, err
+}
+
+// checkQueried returns a deniedError if the version a query resolved to
+// must not be served.
+func (f *fetcher) checkQueried(ctx context.Context, path, version string, t time.Time) error {
+	err := f.cooldown.tooNew(path, version, t)
+	if err == nil {
+		err = f.policy.check(path, version)
+	}
+	if err == nil {
+		err = f.toolchains.check(path, version)
+	}
+	if err == nil {
+		err = f.vulns.check(ctx, path, version, true)
 	}
-	return path
+	return err
 }
 
-func (f *fetcher) Query(ctx context.Context, path, query string) (version string, t time.Time, err error) {
+// latestAllowed returns the latest version of a module that is listed, for
+// @latest queries resolving to a denied one: the list leaves out the
+// versions that are denied, hidden or too young. It returns denied if there
+// is none.
+func (f *fetcher) latestAllowed(ctx context.Context, path string, denied error) (string, time.Time, error) {
+	versions, err := f.List(ctx, path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	versions = slices.Clone(versions)
+	semver.Sort(versions)
+	latest := latestVersion(versions)
+	if latest == "" {
+		return "", time.Time{}, denied
+	}
+	t, err := f.versionTime(ctx, path, latest)
+	return latest, t, err
+}
+
+func (f *fetcher) query(ctx context.Context, path, query string) (version string, t time.Time, err error) {
 	startTime := time.Now()
 	defer func() {
 		upstreamFetchDuration.UpdateDuration(startTime)
@@ -70,11 +254,42 @@ func (f *fetcher) Query(ctx context.Context, path, query string) (version string
 	return f.upstream.Query(ctx, rewrittenPath, query)
 }
 
-func (f *fetcher) List(ctx context.Context, path string) (versions []string, err error) {
-	return f.upstream.List(ctx, f.rewrite(path))
+func (f *fetcher) List(ctx context.Context, path string) ([]string, error) {
+	versions, err := f.upstreamList(ctx, path)
+	if err == nil {
+		versions = f.toolchains.filter(path, f.filterRetracted(ctx, path, versions))
+		versions = f.filterAge(ctx, path, f.vulns.filter(path, f.policy.filter(path, versions)))
+	}
+	markUnavailable(ctx, err)
+	return versions, err
+}
+
+// upstreamList returns the versions of a module known upstream, unfiltered.
+func (f *fetcher) upstreamList(ctx context.Context, path string) ([]string, error) {
+	return f.lists.do(ctx, path, func(ctx context.Context) ([]string, error) {
+		return f.upstream.List(ctx, f.rewrite(path))
+	})
+}
+
+func (f *fetcher) Download(ctx context.Context, path, version string) (io.ReadSeekCloser, io.ReadSeekCloser, io.ReadSeekCloser, error) {
+	err := f.policy.check(path, version)
+	if err == nil {
+		err = f.toolchains.check(path, version)
+	}
+	if err != nil {
+		markDenied(ctx, err)
+		return nil, nil, nil, err
+	}
+	d, err := f.downloads.do(ctx, path+"@"+version, func(ctx context.Context) (download, error) {
+		info, mod, zip, err := f.download(ctx, path, version)
+		return download{info, mod, zip}, err
+	})
+	markUnavailable(ctx, err)
+	markDenied(ctx, err)
+	return d.info, d.mod, d.zip, err
 }
 
-func (f *fetcher) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+func (f *fetcher) download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
 	startTime := time.Now()
 	defer func() {
 		upstreamFetchDuration.UpdateDuration(startTime)
@@ -87,25 +302,234 @@ func (f *fetcher) Download(ctx context.Context, path, version string) (info, mod
 	if rewrittenPath != path {
 		rewriteRulesApplied.Inc()
 	}
-	info, mod, originalZip, err := f.upstream.Download(ctx, rewrittenPath, version)
+	upInfo, upMod, upZip, err := f.upstream.Download(ctx, rewrittenPath, version)
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	defer func() {
+		if err != nil {
+			upInfo.Close()
+			upMod.Close()
+			upZip.Close()
+		}
+	}()
 
 	// Only rewrite if there are rewrite rules and the rewritten path is not the same as the original path
-	if len(f.cfg.RewriteRules) > 0 && rewrittenPath != path {
-		f.logger.Debug("Rewriting zip", "original", path, "rewritten", rewrittenPath)
-		rewrittenZip, err := f.rewriteZip(originalZip)
+	servedMod, servedZip := upMod, upZip
+	if rewrittenPath != path {
+		f.logger.Debug("Rewriting mod and zip", "original", path, "rewritten", rewrittenPath)
+		modData, err := f.rewriteMod(upMod, path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		servedMod = &readSeekCloser{bytes.NewReader(modData)}
+		upMod.Close()
+
+		_, rule, _ := f.rules.toTarget(path)
+		servedZip, err = f.rewriteZip(upZip, rewrittenPath, path, modData, rule.RewriteImports)
 		if err != nil {
 			return nil, nil, nil, err
 		}
-		return info, mod, rewrittenZip, nil
+		upZip.Close()
+	}
+
+	// Hash what is actually served so the recorded sums match the client's go.sum.
+	sums, err := computeSums(servedMod, servedZip)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Licenses are detected once, when the version is first downloaded.
+	// Toolchains are Go releases under the Go license, too large to scan.
+	var licenseIDs []string
+	if f.licenses != nil && path != toolchainModule {
+		if licenseIDs, err = f.licenses.scan(servedZip); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to scan licenses: %w", err)
+		}
+		if err = f.licenses.check(path, version, licenseIDs); err != nil {
+			f.logger.Warn("Refusing module with disallowed license", "module", path, "version", version, "licenses", licenseIDs)
+			return nil, nil, nil, err
+		}
+	}
+
+	// Verified versions are recorded in the private checksum database, so
+	// this comes after every other check.
+	if err = f.checksums.verify(path, version, sums); err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			checksumMismatchesTotal.Inc()
+			f.logger.Error("Refusing module with mismatched checksum", "module", path, "version", version, "error", err)
+		}
+		return nil, nil, nil, err
+	}
+
+	f.recordMeta(ctx, path, rewrittenPath, version, sums, licenseIDs)
+
+	return upInfo, servedMod, servedZip, nil
+}
+
+// recordMeta stores metadata about a freshly downloaded version in the cache.
+// Failures are logged and never fail the download itself.
+func (f *fetcher) recordMeta(ctx context.Context, path, sourcePath, version string, sums moduleSums, licenses []string) {
+	if f.cache == nil {
+		return
+	}
+
+	meta := &cacheMeta{
+		Module:     path,
+		Version:    version,
+		FetchedAt:  time.Now().UTC(),
+		SourcePath: sourcePath,
+		Sums:       sums,
+		Licenses:   licenses,
+	}
+	if _, rule, ok := f.rules.toTarget(path); ok {
+		meta.SourceRule = rule.String()
+	}
+	if err := writeMeta(ctx, f.cache, meta); err != nil {
+		f.logger.Warn("Failed to write cache metadata", "module", path, "version", version, "error", err)
+	}
+}
+
+// cacheVersion downloads a module version into the cache, unless its zip is
+// already there. It reports whether the version was already cached.
+func (f *fetcher) cacheVersion(ctx context.Context, path, version string) (bool, error) {
+	key, err := cacheKey(path, version)
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.cache.Stat(ctx, key+".zip"); err == nil {
+		return true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return false, f.storeVersion(ctx, path, version)
+}
+
+// storeVersion downloads a module version and writes its files to the cache,
+// replacing any cached copy.
+func (f *fetcher) storeVersion(ctx context.Context, path, version string) error {
+	key, err := cacheKey(path, version)
+	if err != nil {
+		return err
+	}
+	info, mod, zip, err := f.Download(ctx, path, version)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		info.Close()
+		mod.Close()
+		zip.Close()
+	}()
+
+	for _, file := range []struct {
+		ext     string
+		content io.ReadSeeker
+	}{
+		{".info", info},
+		{".mod", mod},
+		{".zip", zip},
+	} {
+		if err := f.cache.Put(ctx, key+file.ext, file.content); err != nil {
+			return fmt.Errorf("failed to cache %s: %w", key+file.ext, err)
+		}
 	}
+	return nil
+}
 
-	return info, mod, originalZip, nil
+// vanity maps a path under a rule's target path back to the vanity path. It
+// is the reverse of rewrite and is used for paths found inside module files.
+func (f *fetcher) vanity(path string) string {
+	vanity, _, _ := f.rules.toVanity(path)
+	return vanity
 }
 
-func (f *fetcher) rewriteZip(originalZip io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+// rewriteMod sets the module directive of a go.mod file to the vanity path it
+// is served as, and rewrites the require, replace and exclude paths covered by
+// rewrite rules from target to vanity paths. Without this the go command
+// refuses the module because it declares a different path than the one it
+// was required as.
+func (f *fetcher) rewriteMod(mod io.ReadSeeker, vanityPath string) ([]byte, error) {
+	if _, err := mod.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(mod)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := modfile.ParseLax("go.mod", data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse go.mod: %w", err)
+	}
+	if file.Module == nil {
+		return nil, fmt.Errorf("go.mod has no module directive")
+	}
+
+	if err := file.AddModuleStmt(vanityPath); err != nil {
+		return nil, fmt.Errorf("failed to rewrite module directive: %w", err)
+	}
+
+	// Edit the syntax tree directly, so that statements ignored by
+	// ParseLax are rewritten too and the file keeps its layout.
+	for _, stmt := range file.Syntax.Stmt {
+		switch stmt := stmt.(type) {
+		case *modfile.Line:
+			if len(stmt.Token) > 0 {
+				f.rewriteModLine(stmt.Token[0], stmt.Token[1:])
+			}
+		case *modfile.LineBlock:
+			if len(stmt.Token) == 0 {
+				continue
+			}
+			for _, line := range stmt.Line {
+				f.rewriteModLine(stmt.Token[0], line.Token)
+			}
+		}
+	}
+
+	return file.Format()
+}
+
+// rewriteModLine rewrites the module path tokens of a single go.mod statement.
+func (f *fetcher) rewriteModLine(verb string, tokens []string) {
+	switch verb {
+	case "require", "exclude":
+		if len(tokens) > 0 {
+			tokens[0] = f.rewriteModToken(tokens[0])
+		}
+	case "replace":
+		// replace old [v] => new [v]
+		for i, tok := range tokens {
+			if i == 0 || tokens[i-1] == "=>" {
+				tokens[i] = f.rewriteModToken(tok)
+			}
+		}
+	}
+}
+
+// rewriteModToken maps a possibly quoted module path token to its vanity path.
+// Local filesystem replacements are left untouched.
+func (f *fetcher) rewriteModToken(tok string) string {
+	path := tok
+	if unquoted, err := strconv.Unquote(tok); err == nil {
+		path = unquoted
+	}
+	if modfile.IsDirectoryPath(path) {
+		return tok
+	}
+	if vanity := f.vanity(path); vanity != path {
+		return modfile.AutoQuote(vanity)
+	}
+	return tok
+}
+
+// rewriteZip renames the entries of a module zip from the target module path
+// to the vanity module path. The zip's go.mod, if any, is replaced with mod so that it
+// matches the .mod file served for the same version byte for byte. If
+// rewriteImports is set, import paths covered by rewrite rules are rewritten
+// in every Go source file too.
+func (f *fetcher) rewriteZip(originalZip io.ReadSeekCloser, targetPath, vanityPath string, mod []byte, rewriteImports bool) (io.ReadSeekCloser, error) {
 	// Seek to the beginning of the file.
 	if _, err := originalZip.Seek(0, io.SeekStart); err != nil {
 		return nil, err
@@ -136,13 +560,10 @@ func (f *fetcher) rewriteZip(originalZip io.ReadSeekCloser) (io.ReadSeekCloser,
 	writer := zip.NewWriter(&buf)
 
 	for _, file := range reader.File {
-		// Rewrite the file path
+		// Rewrite the file path. Every entry is prefixed with "<module path>@<version>/".
 		newName := file.Name
-		for _, rule := range f.cfg.RewriteRules {
-			if strings.Contains(newName, rule.TargetPath) {
-				newName = strings.Replace(newName, rule.TargetPath, rule.VanityPath, 1)
-				break
-			}
+		if strings.HasPrefix(newName, targetPath+"@") {
+			newName = vanityPath + strings.TrimPrefix(newName, targetPath)
 		}
 
 		// Create a new file in the zip archive
@@ -151,6 +572,22 @@ func (f *fetcher) rewriteZip(originalZip io.ReadSeekCloser) (io.ReadSeekCloser,
 			return nil, err
 		}
 
+		// Replace the module root go.mod ("<path>@<version>/go.mod") with the rewritten one
+		if isRootGoMod(newName) {
+			if _, err := newFile.Write(mod); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Rewrite the import paths of Go source files if enabled
+		if rewriteImports && isGoSource(newName) {
+			if err := f.copyRewrittenImports(newFile, file); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		// Open the original file
 		rc, err := file.Open()
 		if err != nil {
@@ -173,6 +610,43 @@ func (f *fetcher) rewriteZip(originalZip io.ReadSeekCloser) (io.ReadSeekCloser,
 	return &readSeekCloser{bytes.NewReader(buf.Bytes())}, nil
 }
 
+// copyRewrittenImports writes the Go source file in zf to w with its import
+// paths mapped to vanity paths. Files that don't parse are copied unchanged,
+// so the go command reports the error itself.
+func (f *fetcher) copyRewrittenImports(w io.Writer, zf *zip.File) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	src, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	out, changed, err := rewriteImports(zf.Name, src, f.vanity)
+	if err != nil {
+		f.logger.Debug("Not rewriting imports of unparsable file", "file", zf.Name, "error", err)
+		out = src
+	} else if changed {
+		importsRewrittenTotal.Inc()
+	}
+
+	_, err = w.Write(out)
+	return err
+}
+
+// isRootGoMod reports whether a module zip entry is the go.mod at the root of
+// the module.
+func isRootGoMod(name string) bool {
+	_, rest, ok := strings.Cut(name, "@")
+	if !ok {
+		return false
+	}
+	_, file, _ := strings.Cut(rest, "/")
+	return file == "go.mod"
+}
+
 // readerAtFromReadSeeker adapts a ReadSeeker to a ReaderAt
 type readerAtFromReadSeeker struct {
 	io.ReadSeeker
@@ -8,6 +8,7 @@ require (
 	github.com/aws/aws-sdk-go-v2/config v1.27.27
 	github.com/aws/aws-sdk-go-v2/credentials v1.17.27
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.58.2
+	github.com/google/licensecheck v0.3.1
 	github.com/goproxy/goproxy v0.17.2
 	github.com/knadh/koanf/parsers/toml v0.1.0
 	github.com/knadh/koanf/providers/env v0.1.0
@@ -16,6 +17,7 @@ require (
 	github.com/knadh/koanf/v2 v2.1.1
 	github.com/spf13/pflag v1.0.5
 	github.com/xanzy/go-gitlab v0.108.0
+	golang.org/x/mod v0.19.0
 )
 
 require (
@@ -45,7 +47,6 @@ require (
 	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/valyala/fastrand v1.1.0 // indirect
 	github.com/valyala/histogram v1.2.0 // indirect
-	golang.org/x/mod v0.19.0 // indirect
 	golang.org/x/net v0.23.0 // indirect
 	golang.org/x/oauth2 v0.6.0 // indirect
 	golang.org/x/sys v0.22.0 // indirect
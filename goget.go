@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// goGetTemplate is the page served to the go command (and gopls, pkg.go.dev
+// and friends) when it resolves a vanity import path with ?go-get=1.
+var goGetTemplate = template.Must(template.New("go-get").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="{{.Root}} {{.VCS}} {{.RepoURL}}">
+<meta name="go-source" content="{{.Root}} {{.RepoURL}} {{.RepoURL}}{{.DirPath}} {{.RepoURL}}{{.FilePath}}">
+</head>
+<body>
+go get {{.ImportPath}}
+</body>
+</html>
+`))
+
+// forgeSourcePaths are the paths of the directory and file pages of each
+// supported forge, relative to the repository URL, for go-source tags. %s is
+// the branch.
+var forgeSourcePaths = map[string][2]string{
+	"github": {"/tree/%s{/dir}", "/blob/%s{/dir}/{file}#L{line}"},
+	"gitlab": {"/-/tree/%s{/dir}", "/-/blob/%s{/dir}/{file}#L{line}"},
+	"gitea":  {"/src/branch/%s{/dir}", "/src/branch/%s{/dir}/{file}#L{line}"},
+}
+
+// goGet answers ?go-get=1 requests for paths covered by rewrite rules, so
+// clients that bypass the proxy still resolve vanity paths to the same
+// repositories the proxy fetches from.
+type goGet struct {
+	vcs    string
+	scheme string
+	host   string
+	branch string
+	forge  string
+	rules  ruleSet
+	logger *slog.Logger
+}
+
+func newGoGet(cfg *Config, rules ruleSet, logger *slog.Logger) (*goGet, error) {
+	g := &goGet{
+		vcs:    cfg.GoGet.VCS,
+		scheme: cfg.GoGet.Scheme,
+		host:   cfg.GoGet.Host,
+		branch: cfg.GoGet.Branch,
+		forge:  cfg.GoGet.Forge,
+		rules:  rules,
+		logger: logger,
+	}
+	if _, ok := forgeSourcePaths[g.forge]; g.forge != "" && !ok {
+		return nil, fmt.Errorf("invalid go_get forge %q: must be github, gitlab or gitea", g.forge)
+	}
+	if g.vcs == "" {
+		g.vcs = "git"
+	}
+	if g.scheme == "" {
+		g.scheme = "https"
+	}
+	if g.branch == "" {
+		g.branch = "master"
+	}
+	return g, nil
+}
+
+// sourcePaths returns the go-source directory and file paths of a
+// repository: those of the configured forge, else GitLab's for hosts named
+// after it and GitHub's otherwise.
+func (g *goGet) sourcePaths(repo string) (dir, file string) {
+	forge := g.forge
+	if forge == "" {
+		forge = "github"
+		if host, _, _ := strings.Cut(repo, "/"); strings.Contains(host, "gitlab") {
+			forge = "gitlab"
+		}
+	}
+	paths := forgeSourcePaths[forge]
+	return fmt.Sprintf(paths[0], g.branch), fmt.Sprintf(paths[1], g.branch)
+}
+
+// isGoGet reports whether r is a go-get discovery request.
+func isGoGet(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Query().Get("go-get") == "1"
+}
+
+// ServeHTTP serves the meta tags of the import path made of the request host
+// and path, as the go command requests https://<import path>?go-get=1.
+func (g *goGet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	goGetRequestsTotal.Inc()
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	importPath := strings.TrimSuffix(host+r.URL.Path, "/")
+
+	_, rule, ok := g.rules.toTarget(importPath)
+	if !ok {
+		http.Error(w, "unknown import path", http.StatusNotFound)
+		return
+	}
+	root, target, _ := rule.repoRoot(importPath)
+
+	repo := target
+	if g.host != "" {
+		repo = g.host
+		if i := strings.IndexByte(target, '/'); i >= 0 {
+			repo += target[i:]
+		}
+	}
+
+	dirPath, filePath := g.sourcePaths(repo)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := goGetTemplate.Execute(w, map[string]string{
+		"ImportPath": importPath,
+		"Root":       root,
+		"VCS":        g.vcs,
+		"RepoURL":    g.scheme + "://" + repo,
+		"DirPath":    dirPath,
+		"FilePath":   filePath,
+	}); err != nil {
+		g.logger.Error("Failed to write go-get response", "path", importPath, "error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGoGetSource(t *testing.T) {
+	rules := mustCompileRules(t,
+		RewriteRule{VanityPath: "go.corp.com/lib", TargetPath: "gitlab.corp.com/go/lib"},
+		RewriteRule{VanityPath: "go.corp.com/tool", TargetPath: "github.com/corp/tool"},
+	)
+	tests := []struct {
+		forge, path string
+		want        string
+	}{
+		{"", "go.corp.com/lib/sub", `content="go.corp.com/lib https://gitlab.corp.com/go/lib https://gitlab.corp.com/go/lib/-/tree/main{/dir} https://gitlab.corp.com/go/lib/-/blob/main{/dir}/{file}#L{line}"`},
+		{"", "go.corp.com/tool", `content="go.corp.com/tool https://github.com/corp/tool https://github.com/corp/tool/tree/main{/dir} https://github.com/corp/tool/blob/main{/dir}/{file}#L{line}"`},
+		{"github", "go.corp.com/lib", `content="go.corp.com/lib https://gitlab.corp.com/go/lib https://gitlab.corp.com/go/lib/tree/main{/dir} https://gitlab.corp.com/go/lib/blob/main{/dir}/{file}#L{line}"`},
+		{"gitea", "go.corp.com/tool", `content="go.corp.com/tool https://github.com/corp/tool https://github.com/corp/tool/src/branch/main{/dir} https://github.com/corp/tool/src/branch/main{/dir}/{file}#L{line}"`},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		cfg.GoGet.Branch = "main"
+		cfg.GoGet.Forge = tt.forge
+		g, err := newGoGet(cfg, rules, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		host, urlPath, _ := strings.Cut(tt.path, "/")
+		req := httptest.NewRequest(http.MethodGet, "/"+urlPath+"?go-get=1", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		if !strings.Contains(rec.Body.String(), `<meta name="go-source" `+tt.want+`>`) {
+			t.Errorf("forge %q, %s: go-source tag not found in:\n%s\nwant %s", tt.forge, tt.path, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestGoGetInvalidForge(t *testing.T) {
+	cfg := &Config{}
+	cfg.GoGet.Forge = "sourcehut"
+	if _, err := newGoGet(cfg, ruleSet{}, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Error("expected an error for an unknown forge")
+	}
+}
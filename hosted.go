@@ -0,0 +1,341 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// hostedUpstream is the metrics label of hosted modules.
+const hostedUpstream = "hosted"
+
+var (
+	// errInvalidModule is the base of errors for published modules that
+	// can't be accepted.
+	errInvalidModule = errors.New("invalid module")
+
+	// errVersionExists is returned when publishing a version that already
+	// exists. Published versions are immutable.
+	errVersionExists = errors.New("version already exists")
+)
+
+// hosted serves modules published through the admin API. They have no
+// repository: their files live in the cache only and are never fetched from
+// upstream.
+type hosted struct {
+	patterns string
+	cache    cacheStore
+	logger   *slog.Logger
+
+	// mu serializes publishes, so that a version can't be published twice.
+	mu sync.Mutex
+}
+
+var _ = goproxy.Fetcher(&hosted{})
+
+// newHosted returns nil if publishing is disabled.
+func newHosted(cfg *Config, cache cacheStore, logger *slog.Logger) (*hosted, error) {
+	c := cfg.Publish
+	if !c.Enabled {
+		return nil, nil
+	}
+	if cache == nil {
+		return nil, fmt.Errorf("publishing requires the cache")
+	}
+	if c.Patterns == "" {
+		return nil, fmt.Errorf("missing publish patterns")
+	}
+	if err := validatePatterns(c.Patterns); err != nil {
+		return nil, fmt.Errorf("invalid publish patterns: %w", err)
+	}
+	return &hosted{patterns: c.Patterns, cache: cache, logger: logger}, nil
+}
+
+// versions returns the published versions of a module, sorted.
+func (h *hosted) versions(ctx context.Context, path string) ([]string, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	entries, err := h.cache.List(ctx, escapedPath+"/@v/")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []string{}
+	for _, e := range entries {
+		p, version, ext, ok := parseCacheName(e.Name)
+		if ok && p == path && ext == ".info" {
+			versions = append(versions, version)
+		}
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+func (h *hosted) List(ctx context.Context, path string) ([]string, error) {
+	return h.versions(ctx, path)
+}
+
+// Query resolves "latest", a version prefix such as "v1" or an exact version
+// against the published versions.
+func (h *hosted) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	version := query
+	if query == "latest" || isVersionPrefix(query) {
+		versions, err := h.versions(ctx, path)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if query != "latest" {
+			prefixed := versions[:0]
+			for _, v := range versions {
+				if semver.Major(v) == query || semver.MajorMinor(v) == query {
+					prefixed = append(prefixed, v)
+				}
+			}
+			versions = prefixed
+		}
+		if version = latestVersion(versions); version == "" {
+			return "", time.Time{}, notExist(fmt.Errorf("no published versions for query %q", query))
+		}
+	}
+
+	key, err := cacheKey(path, version)
+	if err != nil {
+		return "", time.Time{}, notExist(err)
+	}
+	b, err := h.read(ctx, key+".info")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return parseInfo(b)
+}
+
+func (h *hosted) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	key, err := cacheKey(path, version)
+	if err != nil {
+		return nil, nil, nil, notExist(err)
+	}
+
+	files := make([]io.ReadSeekCloser, 0, 3)
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		f, err := h.open(ctx, key+ext)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, nil, err
+		}
+		files = append(files, f)
+	}
+	return files[0], files[1], files[2], nil
+}
+
+// open returns a cached file, read into memory if the cache doesn't return
+// seekable files.
+func (h *hosted) open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	rc, err := h.cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if rsc, ok := rc.(io.ReadSeekCloser); ok {
+		return rsc, nil
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &readSeekCloser{bytes.NewReader(b)}, nil
+}
+
+// read returns the content of a small cached file.
+func (h *hosted) read(ctx context.Context, name string) ([]byte, error) {
+	rc, err := h.cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// publish validates a module zip and stores it in the cache as an immutable
+// version of a hosted module. The zip must follow the module zip format, as
+// created by golang.org/x/mod/zip. Its go.mod, if any, must declare the
+// module path. It returns the h1: hashes of the published version.
+func (f *fetcher) publish(ctx context.Context, path, version string, zipFile *os.File) (moduleSums, error) {
+	h := f.hosted
+	m := module.Version{Path: path, Version: version}
+	if err := module.Check(path, version); err != nil {
+		return moduleSums{}, fmt.Errorf("%w: %w", errInvalidModule, err)
+	}
+	if module.CanonicalVersion(version) != version {
+		return moduleSums{}, fmt.Errorf("%w: version %s is not canonical", errInvalidModule, version)
+	}
+	if !module.MatchPrefixPatterns(h.patterns, path) {
+		return moduleSums{}, &deniedError{fmt.Sprintf("%s doesn't match the publish patterns", path)}
+	}
+	// Routes match rewritten paths, so a rewritten module would never
+	// reach the hosted route.
+	if _, rule, ok := f.rules.toTarget(path); ok {
+		return moduleSums{}, fmt.Errorf("%w: %s is rewritten by rule %s", errInvalidModule, path, rule.String())
+	}
+	if _, err := modzip.CheckZip(m, zipFile.Name()); err != nil {
+		return moduleSums{}, fmt.Errorf("%w: %w", errInvalidModule, err)
+	}
+
+	mod, err := zipGoMod(zipFile, m)
+	if err != nil {
+		return moduleSums{}, err
+	}
+	if mod == nil {
+		// The go command synthesizes the go.mod of modules without one.
+		mod = []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(path)))
+	} else if modPath := modfile.ModulePath(mod); modPath != path {
+		return moduleSums{}, fmt.Errorf("%w: go.mod declares module %q, want %q", errInvalidModule, modPath, path)
+	}
+
+	key, err := cacheKey(path, version)
+	if err != nil {
+		return moduleSums{}, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, ext := range []string{".info", ".zip"} {
+		_, err := h.cache.Stat(ctx, key+ext)
+		if err == nil {
+			return moduleSums{}, fmt.Errorf("%w: %s@%s", errVersionExists, path, version)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return moduleSums{}, err
+		}
+	}
+
+	modReader := bytes.NewReader(mod)
+	sums, err := computeSums(modReader, zipFile)
+	if err != nil {
+		return moduleSums{}, err
+	}
+	var licenseIDs []string
+	if f.licenses != nil {
+		if licenseIDs, err = f.licenses.scan(zipFile); err != nil {
+			return moduleSums{}, fmt.Errorf("failed to scan licenses: %w", err)
+		}
+		if err := f.licenses.check(path, version, licenseIDs); err != nil {
+			return moduleSums{}, err
+		}
+	}
+	info, err := json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{version, time.Now().UTC()})
+	if err != nil {
+		return moduleSums{}, err
+	}
+
+	// The .info file is written last: versions are listed by it. The
+	// version is recorded in the private checksum database once it is
+	// stored, and the stored files are removed if either step fails, so
+	// that the version can be published again.
+	var stored []string
+	for _, file := range []struct {
+		ext     string
+		content io.ReadSeeker
+	}{
+		{".mod", modReader},
+		{".zip", zipFile},
+		{".info", bytes.NewReader(info)},
+	} {
+		if _, err := file.content.Seek(0, io.SeekStart); err != nil {
+			h.rollback(ctx, stored)
+			return moduleSums{}, err
+		}
+		if err := h.cache.Put(ctx, key+file.ext, file.content); err != nil {
+			h.rollback(ctx, stored)
+			return moduleSums{}, fmt.Errorf("failed to store %s: %w", key+file.ext, err)
+		}
+		stored = append(stored, key+file.ext)
+	}
+	if f.checksums.private != nil {
+		if err := f.checksums.private.record(path, version, sums); err != nil {
+			h.rollback(ctx, stored)
+			return moduleSums{}, err
+		}
+	}
+
+	meta := &cacheMeta{
+		Module:     path,
+		Version:    version,
+		FetchedAt:  time.Now().UTC(),
+		SourcePath: hostedUpstream,
+		Sums:       sums,
+		Licenses:   licenseIDs,
+	}
+	if err := writeMeta(ctx, h.cache, meta); err != nil {
+		h.logger.Warn("Failed to write cache metadata", "module", path, "version", version, "error", err)
+	}
+
+	publishedTotal.Inc()
+	h.logger.Info("Published module", "module", path, "version", version, "zip", sums.Zip)
+	return sums, nil
+}
+
+// rollback deletes the files of a failed publish.
+func (h *hosted) rollback(ctx context.Context, names []string) {
+	for _, name := range names {
+		if err := h.cache.Delete(ctx, name); err != nil {
+			h.logger.Error("Failed to remove file of a failed publish", "name", name, "error", err)
+		}
+	}
+}
+
+// owns reports whether path is a hosted module path. Hosted modules only
+// exist in the cache, so they can't be purged or fetched again.
+func (h *hosted) owns(path string) bool {
+	return h != nil && module.MatchPrefixPatterns(h.patterns, path)
+}
+
+// zipGoMod returns the go.mod at the root of a module zip, or nil if it has
+// none.
+func zipGoMod(zipFile io.ReadSeeker, m module.Version) ([]byte, error) {
+	size, err := zipFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Seek(0, io.SeekStart)
+
+	z, err := zip.NewReader(&readerAtFromReadSeeker{zipFile}, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidModule, err)
+	}
+	name := m.Path + "@" + m.Version + "/go.mod"
+	for _, file := range z.File {
+		if file.Name != name {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, modzip.MaxGoMod))
+	}
+	return nil, nil
+}
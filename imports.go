@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// rewriteImports rewrites the import paths of a Go source file using the
+// vanity mapping. Only the import path literals are replaced, in place, so
+// build constraints, cgo preambles, comments and the formatting of the rest
+// of the file are preserved byte for byte. It reports whether the file
+// changed; unchanged files are returned as is.
+func rewriteImports(name string, src []byte, vanity func(string) string) ([]byte, bool, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, name, src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var (
+		out  bytes.Buffer
+		last int
+	)
+	for _, imp := range file.Imports {
+		importPath, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid import path %s: %w", imp.Path.Value, err)
+		}
+		newPath := vanity(importPath)
+		if newPath == importPath {
+			continue
+		}
+
+		literal := strconv.Quote(newPath)
+		if strings.HasPrefix(imp.Path.Value, "`") {
+			literal = "`" + newPath + "`"
+		}
+		start := fset.Position(imp.Path.Pos()).Offset
+		end := fset.Position(imp.Path.End()).Offset
+		out.Write(src[last:start])
+		out.WriteString(literal)
+		last = end
+	}
+	if last == 0 {
+		return src, false, nil
+	}
+	out.Write(src[last:])
+	return out.Bytes(), true, nil
+}
+
+// isGoSource reports whether a module zip entry is a Go source file whose
+// imports should be rewritten. Files in testdata directories are ignored by
+// the go command and may hold golden files, so they are left untouched.
+func isGoSource(name string) bool {
+	if path.Ext(name) != ".go" {
+		return false
+	}
+	for _, elem := range strings.Split(path.Dir(name), "/") {
+		if elem == "testdata" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testVanity maps github.com/corp/* back to go.corp.com/*.
+func testVanity(p string) string {
+	if rest, ok := strings.CutPrefix(p, "github.com/corp/"); ok {
+		return "go.corp.com/" + rest
+	}
+	return p
+}
+
+func TestRewriteImports(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		changed bool
+	}{
+		{
+			name: "single import",
+			src: `package a
+
+import "github.com/corp/lib"
+
+func F() {   lib.Do() }
+`,
+			want: `package a
+
+import "go.corp.com/lib"
+
+func F() {   lib.Do() }
+`,
+			changed: true,
+		},
+		{
+			name: "grouped imports with names and comments",
+			src: `package a
+
+import (
+	"fmt"
+	l "github.com/corp/lib" // the library
+	_ "github.com/corp/lib/v2/driver"
+	"github.com/other/x"
+)
+`,
+			want: `package a
+
+import (
+	"fmt"
+	l "go.corp.com/lib" // the library
+	_ "go.corp.com/lib/v2/driver"
+	"github.com/other/x"
+)
+`,
+			changed: true,
+		},
+		{
+			name: "build tags",
+			src: `//go:build linux && !cgo
+// +build linux,!cgo
+
+// Package a does things.
+package a
+
+import "github.com/corp/lib"
+`,
+			want: `//go:build linux && !cgo
+// +build linux,!cgo
+
+// Package a does things.
+package a
+
+import "go.corp.com/lib"
+`,
+			changed: true,
+		},
+		{
+			name: "cgo preamble",
+			src: `package a
+
+/*
+#cgo LDFLAGS: -lm
+#include <math.h>
+// "github.com/corp/lib" in a comment stays.
+*/
+import "C"
+
+import "github.com/corp/lib"
+
+func Sqrt(x float64) float64 { return float64(C.sqrt(C.double(x))) }
+`,
+			want: `package a
+
+/*
+#cgo LDFLAGS: -lm
+#include <math.h>
+// "github.com/corp/lib" in a comment stays.
+*/
+import "C"
+
+import "go.corp.com/lib"
+
+func Sqrt(x float64) float64 { return float64(C.sqrt(C.double(x))) }
+`,
+			changed: true,
+		},
+		{
+			name:    "raw string import",
+			src:     "package a\n\nimport `github.com/corp/lib`\n",
+			want:    "package a\n\nimport `go.corp.com/lib`\n",
+			changed: true,
+		},
+		{
+			name: "unchanged",
+			src: `package a
+
+import "fmt"
+
+func F() {   fmt.Println("github.com/corp/lib") }
+`,
+			want: `package a
+
+import "fmt"
+
+func F() {   fmt.Println("github.com/corp/lib") }
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := rewriteImports("a.go", []byte(tt.src), testVanity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteImportsInvalid(t *testing.T) {
+	if _, _, err := rewriteImports("a.go", []byte("package a\nimport (\n"), testVanity); err == nil {
+		t.Fatal("expected an error for an unparsable file")
+	}
+}
+
+func TestIsGoSource(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"go.corp.com/lib@v1.0.0/lib.go", true},
+		{"go.corp.com/lib@v1.0.0/internal/x/x_test.go", true},
+		{"go.corp.com/lib@v1.0.0/testdata/golden.go", false},
+		{"go.corp.com/lib@v1.0.0/pkg/testdata/src/a/a.go", false},
+		{"go.corp.com/lib@v1.0.0/testdatax/a.go", true},
+		{"go.corp.com/lib@v1.0.0/go.mod", false},
+		{"go.corp.com/lib@v1.0.0/README.md", false},
+	}
+	for _, tt := range tests {
+		if got := isGoSource(tt.name); got != tt.want {
+			t.Errorf("isGoSource(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
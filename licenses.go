@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/google/licensecheck"
+	"golang.org/x/mod/module"
+)
+
+// licenseMinCoverage is the percentage of a license file that must match
+// known licenses for them to be detected, as on pkg.go.dev.
+const licenseMinCoverage = 75
+
+// maxLicenseFileSize bounds the license files read from a zip.
+const maxLicenseFileSize = 1 << 20
+
+// licenseFileNames are the lowercase prefixes of license file names.
+var licenseFileNames = []string{"license", "licence", "copying", "unlicense"}
+
+// licenses detects the licenses of module zips and refuses modules whose
+// licenses aren't allowed.
+type licenses struct {
+	allowed      map[string]bool
+	blockUnknown bool
+	exempt       string
+}
+
+// newLicenses returns nil if license detection is disabled.
+func newLicenses(cfg *Config) (*licenses, error) {
+	c := cfg.Licenses
+	if !c.Enabled {
+		return nil, nil
+	}
+	if err := validatePatterns(c.Exempt); err != nil {
+		return nil, fmt.Errorf("invalid licenses exempt: %w", err)
+	}
+	if c.BlockUnknown && len(c.Allowed) == 0 {
+		return nil, fmt.Errorf("licenses block_unknown requires allowed licenses")
+	}
+
+	l := &licenses{blockUnknown: c.BlockUnknown, exempt: c.Exempt}
+	if len(c.Allowed) > 0 {
+		l.allowed = make(map[string]bool)
+		for _, id := range c.Allowed {
+			l.allowed[id] = true
+		}
+	}
+	return l, nil
+}
+
+// scan returns the SPDX IDs of the licenses found in the license files of a
+// module zip, sorted. Files under vendor directories are skipped.
+func (l *licenses) scan(zipFile io.ReadSeeker) ([]string, error) {
+	size, err := zipFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Seek(0, io.SeekStart)
+
+	z, err := zip.NewReader(&readerAtFromReadSeeker{zipFile}, size)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, file := range z.File {
+		if !isLicenseFile(file.Name) || file.UncompressedSize64 > maxLicenseFileSize {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		text, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		cov := licensecheck.Scan(text)
+		if cov.Percent < licenseMinCoverage {
+			continue
+		}
+		for _, m := range cov.Match {
+			if !slices.Contains(ids, m.ID) {
+				ids = append(ids, m.ID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		metrics.GetOrCreateCounter(fmt.Sprintf("toru_module_licenses_total{license=%q}", id)).Inc()
+	}
+	return ids, nil
+}
+
+// isLicenseFile reports whether a module zip entry is a license file, such
+// as LICENSE, LICENSE.md or COPYING, at the root of the module. Licenses in
+// subdirectories belong to vendored code, test data or third-party packages,
+// not to the module.
+func isLicenseFile(name string) bool {
+	_, rest, ok := strings.Cut(name, "@")
+	if !ok {
+		return false
+	}
+	_, file, _ := strings.Cut(rest, "/")
+	if file == "" || strings.Contains(file, "/") {
+		return false
+	}
+	base := strings.ToLower(file)
+	for _, prefix := range licenseFileNames {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a deniedError if the licenses of a module version aren't all
+// allowed, or if none was detected and unknown licenses are blocked.
+func (l *licenses) check(path, version string, ids []string) error {
+	err := l.decide(path, version, ids)
+	if err != nil {
+		licenseBlockedTotal.Inc()
+	}
+	return err
+}
+
+// decide is check without counting refused versions.
+func (l *licenses) decide(path, version string, ids []string) error {
+	if l == nil || l.allowed == nil || module.MatchPrefixPatterns(l.exempt, path) {
+		return nil
+	}
+	if len(ids) == 0 {
+		if !l.blockUnknown {
+			return nil
+		}
+		return &deniedError{fmt.Sprintf("%s@%s has no recognized license", path, version)}
+	}
+
+	var denied []string
+	for _, id := range ids {
+		if !l.allowed[id] {
+			denied = append(denied, id)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	return &deniedError{fmt.Sprintf("%s@%s is licensed under %s, which is not allowed", path, version, strings.Join(denied, ", "))}
+}
+
+// checkLicenses checks the licenses recorded in the metadata of a cached
+// version, so that cached versions follow the allowed licenses too. Versions
+// without recorded licenses are checked when they are downloaded.
+func (f *fetcher) checkLicenses(ctx context.Context, path, version string) error {
+	if f.licenses == nil || f.licenses.allowed == nil || f.cache == nil {
+		return nil
+	}
+	meta, err := readMeta(ctx, f.cache, path, version)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if meta.Licenses == nil {
+		return nil
+	}
+	return f.licenses.check(path, version, meta.Licenses)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestIsLicenseFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com/m@v1.0.0/LICENSE", true},
+		{"example.com/m@v1.0.0/LICENSE.md", true},
+		{"example.com/m@v1.0.0/COPYING", true},
+		{"example.com/m@v1.0.0/licence.txt", true},
+		{"example.com/m@v1.0.0/README.md", false},
+		{"example.com/m@v1.0.0/testdata/LICENSE", false},
+		{"example.com/m@v1.0.0/vendor/example.org/x/LICENSE", false},
+		{"example.com/m@v1.0.0/third_party/x/LICENSE", false},
+		{"example.com/m@v1.0.0/", false},
+	}
+	for _, tt := range tests {
+		if got := isLicenseFile(tt.name); got != tt.want {
+			t.Errorf("isLicenseFile(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	// errUnavailable is the base of errors reported to clients as 503, as
+	// retrying later is expected to succeed.
+	errUnavailable = errors.New("upstream temporarily unavailable")
+
+	// errOverloaded is returned when an upstream fetch can't get a slot
+	// because the wait queue is full or the wait timed out.
+	errOverloaded = fmt.Errorf("%w: too many concurrent upstream fetches", errUnavailable)
+)
+
+// limiter bounds the number of concurrent upstream fetches, globally and per
+// upstream host. Fetches over the limits wait in a queue, bounded unless
+// maxQueue is 0.
+type limiter struct {
+	// global is nil when there's no global limit.
+	global chan struct{}
+
+	perHost      int
+	hostLimits   map[string]int
+	maxQueue     int32
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+
+	queued atomic.Int32
+}
+
+func newLimiter(cfg *Config) (*limiter, error) {
+	c := cfg.Upstream.Limits
+	if c.MaxConcurrent < 0 || c.MaxPerHost < 0 || c.MaxQueue < 0 {
+		return nil, fmt.Errorf("invalid upstream limits: values can't be negative")
+	}
+	for host, n := range c.Hosts {
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid upstream limit for %s: must be positive", host)
+		}
+	}
+
+	l := &limiter{
+		perHost:      c.MaxPerHost,
+		hostLimits:   c.Hosts,
+		maxQueue:     int32(c.MaxQueue),
+		queueTimeout: c.QueueTimeout,
+		hosts:        make(map[string]chan struct{}),
+	}
+	if c.MaxConcurrent > 0 {
+		l.global = make(chan struct{}, c.MaxConcurrent)
+	}
+	metrics.GetOrCreateGauge("toru_upstream_queued", func() float64 {
+		return float64(l.queued.Load())
+	})
+	return l, nil
+}
+
+// hostSlots returns the semaphore of a host, or nil if it isn't limited.
+func (l *limiter) hostSlots(host string) chan struct{} {
+	n, ok := l.hostLimits[host]
+	if !ok {
+		n = l.perHost
+	}
+	if n == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.hosts[host]
+	if !ok {
+		s = make(chan struct{}, n)
+		l.hosts[host] = s
+	}
+	return s
+}
+
+// acquire takes a global and a host slot, queueing if none is free. The
+// returned function releases them.
+func (l *limiter) acquire(ctx context.Context, host string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	label := fmt.Sprintf("{host=%q}", host)
+	sems := []chan struct{}{l.hostSlots(host), l.global}
+
+	// Fast path: free slots, no queueing.
+	taken := 0
+	for ; taken < len(sems); taken++ {
+		if sems[taken] == nil {
+			continue
+		}
+		select {
+		case sems[taken] <- struct{}{}:
+			continue
+		default:
+		}
+		break
+	}
+	if taken == len(sems) {
+		return release(sems), nil
+	}
+
+	if n := l.queued.Add(1); l.maxQueue > 0 && n > l.maxQueue {
+		l.queued.Add(-1)
+		release(sems[:taken])()
+		metrics.GetOrCreateCounter("toru_upstream_rejected_total" + label).Inc()
+		return nil, errOverloaded
+	}
+	defer l.queued.Add(-1)
+
+	startTime := time.Now()
+	defer metrics.GetOrCreateSummary("toru_upstream_queue_duration_seconds" + label).UpdateDuration(startTime)
+
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		t := time.NewTimer(l.queueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for ; taken < len(sems); taken++ {
+		if sems[taken] == nil {
+			continue
+		}
+		select {
+		case sems[taken] <- struct{}{}:
+		case <-timeout:
+			release(sems[:taken])()
+			metrics.GetOrCreateCounter("toru_upstream_rejected_total" + label).Inc()
+			return nil, errOverloaded
+		case <-ctx.Done():
+			release(sems[:taken])()
+			return nil, ctx.Err()
+		}
+	}
+	return release(sems), nil
+}
+
+func release(sems []chan struct{}) func() {
+	return func() {
+		for _, s := range sems {
+			if s != nil {
+				<-s
+			}
+		}
+	}
+}
+
+// unavailableKey is the context key of the flag set when a request failed
+// because of errUnavailable.
+type unavailableKey struct{}
+
+// withUnavailableFlag returns a context that can be marked as unavailable.
+func withUnavailableFlag(ctx context.Context) (context.Context, *atomic.Bool) {
+	flag := &atomic.Bool{}
+	return context.WithValue(ctx, unavailableKey{}, flag), flag
+}
+
+// markUnavailable flags the request of ctx if err is errUnavailable, so that
+// it is answered with 503 instead of goproxy's generic 500.
+func markUnavailable(ctx context.Context, err error) {
+	if !errors.Is(err, errUnavailable) {
+		return
+	}
+	if flag, ok := ctx.Value(unavailableKey{}).(*atomic.Bool); ok {
+		flag.Store(true)
+	}
+}
+
+// writeUnavailable writes a 503 response asking the client to retry later,
+// after 5s unless retryAfter is set.
+func writeUnavailable(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = 5 * time.Second
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	http.Error(w, errUnavailable.Error()+", retry later", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// localUpstream is the metrics label of modules served from local sources.
+const localUpstream = "local"
+
+// defaultVersionFile is the file holding the version of modules served from
+// a directory.
+const defaultVersionFile = "VERSION"
+
+// LocalModule serves the modules under a path prefix from a local directory
+// or git repository instead of an upstream.
+type LocalModule struct {
+	// Prefix is the module path of the root of Dir or Git. A module at
+	// <Prefix>/foo lives in the foo subdirectory.
+	Prefix string `koanf:"prefix"`
+
+	// Dir is a directory, such as a monorepo checkout, serving a single
+	// version of each module: the one in its version file.
+	Dir string `koanf:"dir"`
+
+	// Git is a git repository, bare or not, serving the versions tagged
+	// as in a Go monorepo: v1.2.3 for the root module and foo/v1.2.3 for
+	// the module in foo.
+	Git string `koanf:"git"`
+
+	// VersionFile is the name of the file in each module directory that
+	// holds its version, when serving from Dir. Defaults to "VERSION".
+	VersionFile string `koanf:"version_file"`
+}
+
+// localSource builds the files of module versions from a local directory or
+// git repository, without the go command. It is a goproxy.Fetcher.
+type localSource struct {
+	LocalModule
+	logger *slog.Logger
+}
+
+var _ = goproxy.Fetcher(&localSource{})
+
+// newLocalSources validates the local modules.
+func newLocalSources(cfg *Config, logger *slog.Logger) ([]*localSource, error) {
+	var sources []*localSource
+	for i, lm := range cfg.LocalModules {
+		if err := module.CheckImportPath(lm.Prefix); err != nil {
+			return nil, fmt.Errorf("invalid local module %d: %w", i+1, err)
+		}
+		if (lm.Dir == "") == (lm.Git == "") {
+			return nil, fmt.Errorf("invalid local module %d: exactly one of dir or git is required", i+1)
+		}
+		for _, dir := range []string{lm.Dir, lm.Git} {
+			if dir == "" {
+				continue
+			}
+			if !filepath.IsAbs(dir) {
+				return nil, fmt.Errorf("invalid local module %d: %s is not an absolute path", i+1, dir)
+			}
+			if fi, err := os.Stat(dir); err != nil {
+				return nil, fmt.Errorf("invalid local module %d: %w", i+1, err)
+			} else if !fi.IsDir() {
+				return nil, fmt.Errorf("invalid local module %d: %s is not a directory", i+1, dir)
+			}
+		}
+		if lm.VersionFile == "" {
+			lm.VersionFile = defaultVersionFile
+		}
+		sources = append(sources, &localSource{LocalModule: lm, logger: logger})
+		logger.Info("Local module source", "prefix", lm.Prefix, "dir", lm.Dir, "git", lm.Git)
+	}
+	return sources, nil
+}
+
+// moduleLocation is where a module lives in a source.
+type moduleLocation struct {
+	// dir is the module directory relative to the source root.
+	dir string
+
+	// tagPrefix prefixes the version tags of the module. It follows the
+	// module path without its major version suffix, as the go command
+	// does: foo/v2.0.0 for example.com/mono/foo/v2, whether the module is
+	// in foo or in foo/v2.
+	tagPrefix string
+}
+
+// tag returns the git tag of a version.
+func (l moduleLocation) tag(version string) string {
+	return l.tagPrefix + version
+}
+
+// locate returns where a module lives. The modules of a major version, such
+// as foo/v2, may live in foo/v2 or in foo.
+func (s *localSource) locate(ctx context.Context, path string) (moduleLocation, error) {
+	if path != s.Prefix && !strings.HasPrefix(path, s.Prefix+"/") {
+		return moduleLocation{}, notExist(fmt.Errorf("%s is not under %s", path, s.Prefix))
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(path, s.Prefix), "/")
+
+	candidates := []string{rel}
+	tagDir := rel
+	if prefix, _, ok := module.SplitPathVersion(path); ok && prefix != path {
+		tagDir = ""
+		if prefix != s.Prefix && strings.HasPrefix(prefix, s.Prefix+"/") {
+			tagDir = strings.TrimPrefix(prefix, s.Prefix+"/")
+		}
+		candidates = append(candidates, tagDir)
+	}
+	for _, dir := range candidates {
+		if _, err := s.readFile(ctx, s.headRef(), subdirPath(dir, "go.mod")); err == nil {
+			loc := moduleLocation{dir: dir}
+			if tagDir != "" {
+				loc.tagPrefix = tagDir + "/"
+			}
+			return loc, nil
+		}
+	}
+	return moduleLocation{}, notExist(fmt.Errorf("no go.mod for %s in %s", path, s.root()))
+}
+
+func (s *localSource) root() string {
+	if s.Git != "" {
+		return s.Git
+	}
+	return s.Dir
+}
+
+// headRef is the git revision looked at to find modules.
+func (s *localSource) headRef() string {
+	if s.Git != "" {
+		return "HEAD"
+	}
+	return ""
+}
+
+// readFile reads a file of the source, at a revision for git sources.
+func (s *localSource) readFile(ctx context.Context, rev, name string) ([]byte, error) {
+	if s.Git == "" {
+		b, err := os.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(name)))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, notExist(err)
+		}
+		return b, err
+	}
+	b, err := s.git(ctx, "cat-file", "blob", rev+":"+name)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	return b, nil
+}
+
+// git runs a git command in the repository and returns its output.
+func (s *localSource) git(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.autocrlf=input", "-c", "core.eol=lf"}, args...)...)
+	cmd.Dir = s.Git
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// versions returns the versions of a module, sorted, and where it lives.
+func (s *localSource) versions(ctx context.Context, path string) ([]string, moduleLocation, error) {
+	loc, err := s.locate(ctx, path)
+	if err != nil {
+		return nil, moduleLocation{}, err
+	}
+
+	if s.Git == "" {
+		b, err := s.readFile(ctx, "", subdirPath(loc.dir, s.VersionFile))
+		if err != nil {
+			return nil, moduleLocation{}, err
+		}
+		v := strings.TrimSpace(string(b))
+		if !s.validVersion(path, v) {
+			return nil, moduleLocation{}, notExist(fmt.Errorf("invalid version %q in %s", v, subdirPath(loc.dir, s.VersionFile)))
+		}
+		return []string{v}, loc, nil
+	}
+
+	out, err := s.git(ctx, "tag", "--list", loc.tag("v*"))
+	if err != nil {
+		return nil, moduleLocation{}, err
+	}
+	versions := []string{}
+	for _, tag := range strings.Fields(string(out)) {
+		v := strings.TrimPrefix(tag, loc.tagPrefix)
+		if s.validVersion(path, v) {
+			versions = append(versions, v)
+		}
+	}
+	semver.Sort(versions)
+	return versions, loc, nil
+}
+
+// validVersion reports whether v is a canonical version of the module,
+// matching its major version suffix.
+func (s *localSource) validVersion(path, v string) bool {
+	return semver.Canonical(v) == v && module.Check(path, v) == nil
+}
+
+func (s *localSource) List(ctx context.Context, path string) ([]string, error) {
+	versions, _, err := s.versions(ctx, path)
+	return versions, err
+}
+
+// Query resolves "latest", a version prefix such as "v1" or an exact version.
+func (s *localSource) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	versions, loc, err := s.versions(ctx, path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var matched []string
+	for _, v := range versions {
+		if query == "latest" || v == query || (isVersionPrefix(query) && (semver.Major(v) == query || semver.MajorMinor(v) == query)) {
+			matched = append(matched, v)
+		}
+	}
+	version := latestVersion(matched)
+	if version == "" {
+		return "", time.Time{}, notExist(fmt.Errorf("no matching versions for query %q", query))
+	}
+	t, err := s.versionTime(ctx, loc, version)
+	return version, t, err
+}
+
+// versionTime returns the commit time of a tag, or the modification time of
+// the version file.
+func (s *localSource) versionTime(ctx context.Context, loc moduleLocation, version string) (time.Time, error) {
+	if s.Git == "" {
+		fi, err := os.Stat(filepath.Join(s.Dir, filepath.FromSlash(subdirPath(loc.dir, s.VersionFile))))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return fi.ModTime().UTC(), nil
+	}
+	out, err := s.git(ctx, "log", "-1", "--format=%cI", loc.tag(version)+"^{commit}")
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out)))
+	return t.UTC(), err
+}
+
+func (s *localSource) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	versions, loc, err := s.versions(ctx, path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	found := false
+	for _, v := range versions {
+		found = found || v == version
+	}
+	if !found {
+		return nil, nil, nil, notExist(fmt.Errorf("unknown version %s of %s", version, path))
+	}
+
+	rev := ""
+	if s.Git != "" {
+		rev = loc.tag(version)
+	}
+	modData, err := s.readFile(ctx, rev, subdirPath(loc.dir, "go.mod"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if modPath := modfile.ModulePath(modData); modPath != path {
+		return nil, nil, nil, notExist(fmt.Errorf("go.mod declares module %q, want %q", modPath, path))
+	}
+
+	t, err := s.versionTime(ctx, loc, version)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	infoData, err := json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{version, t})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	startTime := time.Now()
+	zip, err = s.zip(ctx, module.Version{Path: path, Version: version}, loc.dir, rev)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.logger.Debug("Built module zip from local source", "module", path, "version", version, "root", s.root(), "duration", time.Since(startTime))
+	return &readSeekCloser{bytes.NewReader(infoData)}, &readSeekCloser{bytes.NewReader(modData)}, zip, nil
+}
+
+// zip creates the module zip of a version in a temporary file, removed when
+// it is closed.
+func (s *localSource) zip(ctx context.Context, m module.Version, dir, rev string) (io.ReadSeekCloser, error) {
+	f, err := os.CreateTemp("", "toru-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &tempFile{f}
+
+	if s.Git == "" {
+		err = modzip.CreateFromDir(f, m, filepath.Join(s.Dir, filepath.FromSlash(dir)))
+	} else {
+		var files []modzip.File
+		if files, err = s.gitFiles(ctx, rev, dir); err == nil {
+			err = modzip.Create(f, m, files)
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to create zip of %s@%s: %w", m.Path, m.Version, err)
+	}
+	return tmp, nil
+}
+
+// gitFiles lists the files of a module directory at a revision, as the go
+// command does: from git archive, with the LICENSE of the repository root
+// if the module has none.
+func (s *localSource) gitFiles(ctx context.Context, rev, dir string) ([]modzip.File, error) {
+	args := []string{"archive", "--format=zip", rev}
+	if dir != "" {
+		args = append(args, dir)
+	}
+	out, err := s.git(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	z, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		files       []modzip.File
+		haveLicense bool
+	)
+	for _, zf := range z.File {
+		name := zf.Name
+		if dir != "" {
+			var ok bool
+			if name, ok = strings.CutPrefix(name, dir+"/"); !ok {
+				continue
+			}
+		}
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		files = append(files, gitFile{name: name, f: zf})
+		haveLicense = haveLicense || name == "LICENSE"
+	}
+	if !haveLicense && dir != "" {
+		if license, err := s.readFile(ctx, rev, "LICENSE"); err == nil {
+			files = append(files, dataFile{name: "LICENSE", data: license})
+		}
+	}
+	return files, nil
+}
+
+// gitFile is a file of a git archive.
+type gitFile struct {
+	name string
+	f    *zip.File
+}
+
+func (f gitFile) Path() string                 { return f.name }
+func (f gitFile) Lstat() (os.FileInfo, error)  { return f.f.FileInfo(), nil }
+func (f gitFile) Open() (io.ReadCloser, error) { return f.f.Open() }
+
+// dataFile is a file whose content is in memory.
+type dataFile struct {
+	name string
+	data []byte
+}
+
+func (f dataFile) Path() string                { return f.name }
+func (f dataFile) Lstat() (os.FileInfo, error) { return dataFileInfo{f}, nil }
+func (f dataFile) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+type dataFileInfo struct {
+	f dataFile
+}
+
+func (fi dataFileInfo) Name() string       { return path.Base(fi.f.name) }
+func (fi dataFileInfo) Size() int64        { return int64(len(fi.f.data)) }
+func (fi dataFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi dataFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi dataFileInfo) IsDir() bool        { return false }
+func (fi dataFileInfo) Sys() interface{}   { return nil }
+
+// subdirPath joins a module subdirectory and a name, which is returned as is
+// for the root directory.
+func subdirPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, by slash-separated name, under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fixtureRepo creates a git monorepo with:
+//
+//	example.com/mono          in the root, tagged v1.0.0 and v1.1.0
+//	example.com/mono/v2       in v2/, tagged v2.0.0
+//	example.com/mono/foo      in foo/, tagged foo/v0.1.0
+//	example.com/mono/foo/v2   in foo/v2/, tagged foo/v2.0.0
+//	example.com/mono/bar/v3   in bar/, tagged bar/v3.0.0
+func fixtureRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false", "-c", "tag.gpgsign=false"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	git("init", "-q")
+	writeFiles(t, dir, map[string]string{
+		"LICENSE":       "root license\n",
+		"go.mod":        "module example.com/mono\n",
+		"mono.go":       "package mono\n",
+		"foo/go.mod":    "module example.com/mono/foo\n",
+		"foo/foo.go":    "package foo\n",
+		"foo/v2/go.mod": "module example.com/mono/foo/v2\n",
+		"foo/v2/foo.go": "package foo\n",
+		"bar/go.mod":    "module example.com/mono/bar/v3\n",
+		"bar/bar.go":    "package bar\n",
+		"v2/go.mod":     "module example.com/mono/v2\n",
+		"v2/mono.go":    "package mono\n",
+	})
+	git("add", "-A")
+	git("commit", "-q", "-m", "first")
+	for _, tag := range []string{"v1.0.0", "v2.0.0", "foo/v0.1.0", "foo/v2.0.0", "bar/v3.0.0", "foo/not-a-version"} {
+		git("tag", tag)
+	}
+
+	writeFiles(t, dir, map[string]string{"mono.go": "package mono\n\n// Changed.\n"})
+	git("commit", "-q", "-a", "-m", "second")
+	git("tag", "v1.1.0")
+	return dir
+}
+
+func TestLocalSourceGit(t *testing.T) {
+	ctx := context.Background()
+	s := &localSource{
+		LocalModule: LocalModule{Prefix: "example.com/mono", Git: fixtureRepo(t)},
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	lists := []struct {
+		path string
+		want []string
+	}{
+		{"example.com/mono", []string{"v1.0.0", "v1.1.0"}},
+		{"example.com/mono/v2", []string{"v2.0.0"}},
+		{"example.com/mono/foo", []string{"v0.1.0"}},
+		{"example.com/mono/foo/v2", []string{"v2.0.0"}},
+		{"example.com/mono/bar/v3", []string{"v3.0.0"}},
+	}
+	for _, tt := range lists {
+		got, err := s.List(ctx, tt.path)
+		if err != nil {
+			t.Errorf("List(%s): %v", tt.path, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("List(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	for _, p := range []string{"example.com/mono/missing", "example.com/other"} {
+		if _, err := s.List(ctx, p); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("List(%s) error = %v, want not exist", p, err)
+		}
+	}
+
+	version, _, err := s.Query(ctx, "example.com/mono", "latest")
+	if err != nil || version != "v1.1.0" {
+		t.Errorf("Query(latest) = %s, %v, want v1.1.0", version, err)
+	}
+	version, _, err = s.Query(ctx, "example.com/mono/foo/v2", "v2")
+	if err != nil || version != "v2.0.0" {
+		t.Errorf("Query(foo/v2, v2) = %s, %v, want v2.0.0", version, err)
+	}
+
+	downloads := []struct {
+		path, version string
+		mod           string
+		files         []string
+	}{
+		{"example.com/mono", "v1.0.0", "module example.com/mono\n", []string{"LICENSE", "go.mod", "mono.go"}},
+		{"example.com/mono/foo/v2", "v2.0.0", "module example.com/mono/foo/v2\n", []string{"LICENSE", "foo.go", "go.mod"}},
+		{"example.com/mono/bar/v3", "v3.0.0", "module example.com/mono/bar/v3\n", []string{"LICENSE", "bar.go", "go.mod"}},
+	}
+	for _, tt := range downloads {
+		info, mod, zipFile, err := s.Download(ctx, tt.path, tt.version)
+		if err != nil {
+			t.Errorf("Download(%s@%s): %v", tt.path, tt.version, err)
+			continue
+		}
+		info.Close()
+		modData, _ := io.ReadAll(mod)
+		mod.Close()
+		if string(modData) != tt.mod {
+			t.Errorf("Download(%s@%s) go.mod = %q, want %q", tt.path, tt.version, modData, tt.mod)
+		}
+		if got := zipNames(t, zipFile, tt.path+"@"+tt.version+"/"); !slices.Equal(got, tt.files) {
+			t.Errorf("Download(%s@%s) files = %v, want %v", tt.path, tt.version, got, tt.files)
+		}
+		zipFile.Close()
+	}
+
+	// Nested modules are left out of the root module's zip.
+	_, _, zipFile, err := s.Download(ctx, "example.com/mono", "v1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zipFile.Close()
+	if got := zipNames(t, zipFile, "example.com/mono@v1.1.0/"); !slices.Equal(got, []string{"LICENSE", "go.mod", "mono.go"}) {
+		t.Errorf("root zip files = %v", got)
+	}
+}
+
+func TestLocalSourceDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"lib/go.mod":  "module example.com/tools/lib\n",
+		"lib/lib.go":  "package lib\n",
+		"lib/VERSION": "v1.4.2\n",
+		"bad/go.mod":  "module example.com/tools/bad\n",
+		"bad/VERSION": "latest\n",
+	})
+	s := &localSource{
+		LocalModule: LocalModule{Prefix: "example.com/tools", Dir: dir, VersionFile: defaultVersionFile},
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	got, err := s.List(ctx, "example.com/tools/lib")
+	if err != nil || !slices.Equal(got, []string{"v1.4.2"}) {
+		t.Errorf("List(lib) = %v, %v", got, err)
+	}
+	if _, err := s.List(ctx, "example.com/tools/bad"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("List(bad) error = %v, want not exist", err)
+	}
+
+	_, _, zipFile, err := s.Download(ctx, "example.com/tools/lib", "v1.4.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zipFile.Close()
+	if got := zipNames(t, zipFile, "example.com/tools/lib@v1.4.2/"); !slices.Equal(got, []string{"VERSION", "go.mod", "lib.go"}) {
+		t.Errorf("zip files = %v", got)
+	}
+	if _, _, _, err := s.Download(ctx, "example.com/tools/lib", "v1.0.0"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Download of an unknown version error = %v, want not exist", err)
+	}
+}
+
+// zipNames returns the sorted names of the files in a module zip, relative
+// to prefix.
+func zipNames(t *testing.T, r io.ReadSeeker, prefix string) []string {
+	t.Helper()
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(&readerAtFromReadSeeker{r}, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range z.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok {
+			t.Errorf("zip file %s is not under %s", f.Name, prefix)
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
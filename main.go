@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -13,6 +14,15 @@ import (
 )
 
 func main() {
+	// Subcommands run instead of the proxy.
+	if len(os.Args) > 1 && os.Args[1] == "publish" {
+		if err := runPublish(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "toru publish:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize configuration
 	cfg, err := initConfig("config.toml", "TORU_")
 	if err != nil {
@@ -53,12 +63,62 @@ func main() {
 		}
 	}()
 
+	// Start the admin API on its own listener if enabled
+	var adminServer *http.Server
+	if cfg.Admin.Enabled {
+		admin, err := newAdmin(p, cfg, logger)
+		if err != nil {
+			logger.Error("Failed to create admin API", "error", err)
+			os.Exit(1)
+		}
+		adminServer = &http.Server{
+			Addr:    cfg.Admin.Address,
+			Handler: admin.Handler(),
+		}
+
+		go func() {
+			logger.Info("Starting admin API", "address", cfg.Admin.Address)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("Admin server error", "error", err)
+			}
+		}()
+	}
+
+	// Download the configured toolchains into the cache in the background
+	go p.fetcher.prewarmToolchains(context.Background())
+
+	// Mirror the configured modules on a schedule until shutdown
+	mirror, err := newMirror(cfg, p.fetcher, logger)
+	if err != nil {
+		logger.Error("Failed to create mirror", "error", err)
+		os.Exit(1)
+	}
+	mirrorCtx, stopMirror := context.WithCancel(context.Background())
+	defer stopMirror()
+	if mirror != nil {
+		go mirror.run(mirrorCtx)
+	}
+
+	// Reload the module policy on SIGHUP
+	if pol := p.fetcher.policy; pol != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := pol.reload(); err != nil {
+					logger.Error("Failed to reload policy", "error", err)
+				}
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	logger.Info("Shutting down server gracefully...")
+	stopMirror()
 
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
@@ -69,6 +129,11 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Error("Server forced to shutdown", "error", err)
 	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logger.Error("Admin server forced to shutdown", "error", err)
+		}
+	}
 
 	logger.Info("Server exited")
 }
@@ -18,6 +18,63 @@ var (
 	// Rewrite rules applied
 	rewriteRulesApplied = metrics.NewCounter("toru_rewrite_rules_applied_total")
 
+	// Go source files with rewritten imports
+	importsRewrittenTotal = metrics.NewCounter("toru_imports_rewritten_total")
+
+	// go-get meta tag requests served for vanity paths
+	goGetRequestsTotal = metrics.NewCounter("toru_goget_requests_total")
+
 	// Errors encountered
 	errorsTotal = metrics.NewCounter("toru_errors_total")
+
+	// Downloads refused because of a checksum database mismatch
+	checksumMismatchesTotal = metrics.NewCounter("toru_checksum_mismatches_total")
+
+	// Module versions recorded in the private checksum database
+	privateSumDBRecordsTotal = metrics.NewCounter("toru_private_sumdb_records_total")
+
+	// Requests and fetches denied by the module policy
+	policyDeniedTotal = metrics.NewCounter("toru_policy_denied_total")
+
+	// Policy reloads that failed and kept the previous rules
+	policyReloadErrorsTotal = metrics.NewCounter("toru_policy_reload_errors_total")
+
+	// Vulnerable module versions served with a warning
+	vulnWarningsTotal = metrics.NewCounter("toru_vuln_warnings_total")
+
+	// Vulnerability database refreshes that failed and kept the previous snapshot
+	vulnDBRefreshErrorsTotal = metrics.NewCounter("toru_vulndb_refresh_errors_total")
+
+	// Versions held back because they are younger than the minimum age
+	cooldownRefusedTotal = metrics.NewCounter("toru_cooldown_refused_total")
+
+	// Zip downloads of versions retracted by their module's author
+	retractedRequestsTotal = metrics.NewCounter("toru_retracted_requests_total")
+
+	// Downloads refused because of their licenses
+	licenseBlockedTotal = metrics.NewCounter("toru_license_blocked_total")
+
+	// Requests for toolchains that aren't served
+	toolchainDeniedTotal = metrics.NewCounter("toru_toolchain_denied_total")
+
+	// Toolchains downloaded into the cache at startup
+	toolchainPrewarmedTotal = metrics.NewCounter("toru_toolchain_prewarmed_total")
+
+	// Scheduled mirror runs
+	mirrorRunsTotal = metrics.NewCounter("toru_mirror_runs_total")
+
+	// Module versions downloaded into the cache by mirror runs
+	mirrorVersionsTotal = metrics.NewCounter("toru_mirror_versions_total")
+
+	// Modules and versions that mirror runs failed to list or download
+	mirrorErrorsTotal = metrics.NewCounter("toru_mirror_errors_total")
+
+	// Duration of mirror runs
+	mirrorRunDuration = metrics.NewSummary("toru_mirror_run_duration_seconds")
+
+	// Module versions published through the admin API
+	publishedTotal = metrics.NewCounter("toru_published_total")
+
+	// Cache entries purged via the admin API
+	cachePurgedTotal = metrics.NewCounter("toru_cache_purged_total")
 )
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// mirror periodically downloads new versions of a set of modules into the
+// cache, so that critical dependencies are cached before anyone asks for
+// them and stay available if their upstream goes away.
+type mirror struct {
+	fetcher     *fetcher
+	modules     []string
+	interval    time.Duration
+	jitter      time.Duration
+	concurrency int
+	maxVersions int
+	logger      *slog.Logger
+}
+
+// newMirror returns nil if mirroring is disabled.
+func newMirror(cfg *Config, f *fetcher, logger *slog.Logger) (*mirror, error) {
+	c := cfg.Mirror
+	if !c.Enabled {
+		return nil, nil
+	}
+	if f.cache == nil {
+		return nil, fmt.Errorf("mirroring requires the cache")
+	}
+	if len(c.Modules) == 0 {
+		return nil, fmt.Errorf("missing modules to mirror")
+	}
+	for _, pattern := range c.Modules {
+		if err := module.CheckImportPath(strings.TrimSuffix(pattern, "/...")); err != nil {
+			return nil, fmt.Errorf("invalid module to mirror %q: %w", pattern, err)
+		}
+	}
+	if c.Interval < 0 || c.Jitter < 0 || c.Concurrency < 0 || c.MaxVersions < 0 {
+		return nil, fmt.Errorf("invalid mirror settings: values can't be negative")
+	}
+
+	m := &mirror{
+		fetcher:     f,
+		modules:     c.Modules,
+		interval:    c.Interval,
+		jitter:      c.Jitter,
+		concurrency: c.Concurrency,
+		maxVersions: c.MaxVersions,
+		logger:      logger,
+	}
+	if m.interval == 0 {
+		m.interval = time.Hour
+	}
+	if m.concurrency == 0 {
+		m.concurrency = 4
+	}
+	return m, nil
+}
+
+// run mirrors the modules every interval, after a random delay of up to
+// jitter so that replicas don't hit upstream at the same time. It returns
+// when ctx is done.
+func (m *mirror) run(ctx context.Context) {
+	// The first run starts right away, spread by the jitter only.
+	var delay time.Duration
+	for {
+		if m.jitter > 0 {
+			delay += rand.N(m.jitter)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		m.sync(ctx)
+		delay = m.interval
+	}
+}
+
+// mirrorTask is a module version to download.
+type mirrorTask struct {
+	path, version string
+}
+
+// sync downloads the versions of the mirrored modules that aren't cached.
+func (m *mirror) sync(ctx context.Context) {
+	startTime := time.Now()
+	mirrorRunsTotal.Inc()
+
+	var tasks []mirrorTask
+	failed := 0
+	modules := m.expand(ctx)
+	for _, path := range modules {
+		versions, err := m.fetcher.List(ctx, path)
+		if err != nil {
+			mirrorErrorsTotal.Inc()
+			failed++
+			m.logger.Error("Failed to list mirrored module", "module", path, "error", err)
+			continue
+		}
+		for _, version := range m.newest(versions) {
+			tasks = append(tasks, mirrorTask{path, version})
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		mirrored int
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, m.concurrency)
+	)
+	for _, t := range tasks {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			versionStart := time.Now()
+			cached, err := m.fetcher.cacheVersion(ctx, t.path, t.version)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				mirrorErrorsTotal.Inc()
+				failed++
+				m.logger.Error("Failed to mirror module version", "module", t.path, "version", t.version, "error", err)
+			case !cached:
+				mirrorVersionsTotal.Inc()
+				mirrored++
+				m.logger.Info("Mirrored module version", "module", t.path, "version", t.version, "duration", time.Since(versionStart))
+			}
+		}()
+	}
+	wg.Wait()
+
+	mirrorRunDuration.UpdateDuration(startTime)
+	m.logger.Info("Mirror run finished",
+		"modules", len(modules),
+		"versions", len(tasks),
+		"mirrored", mirrored,
+		"failed", failed,
+		"duration", time.Since(startTime),
+	)
+}
+
+// expand returns the module paths to mirror. A pattern ending in "/..."
+// matches the cached modules at or under its path, since a module proxy
+// can't list the modules under a path.
+func (m *mirror) expand(ctx context.Context) []string {
+	var paths []string
+	for _, pattern := range m.modules {
+		prefix, ok := strings.CutSuffix(pattern, "/...")
+		if !ok {
+			paths = append(paths, pattern)
+			continue
+		}
+
+		escapedPrefix, err := module.EscapePath(prefix)
+		if err != nil {
+			continue
+		}
+		entries, err := m.fetcher.cache.List(ctx, escapedPrefix+"/")
+		if err != nil {
+			mirrorErrorsTotal.Inc()
+			m.logger.Error("Failed to list cached modules to mirror", "pattern", pattern, "error", err)
+			continue
+		}
+		for _, e := range entries {
+			if p, _, ext, ok := parseCacheName(e.Name); ok && ext == ".info" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// newest returns the versions to mirror: the newest maxVersions, or all of
+// them if it is 0.
+func (m *mirror) newest(versions []string) []string {
+	versions = slices.Clone(versions)
+	semver.Sort(versions)
+	if m.maxVersions > 0 && len(versions) > m.maxVersions {
+		versions = versions[len(versions)-m.maxVersions:]
+	}
+	return versions
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Policy actions.
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// errDenied is the base of errors for modules and versions the policy
+// doesn't allow.
+var errDenied = errors.New("denied by policy")
+
+// PolicyRule is a rule of the policy file.
+type PolicyRule struct {
+	// Action is "allow" or "deny".
+	Action string `koanf:"action" json:"action"`
+
+	// Pattern is a comma-separated list of module path patterns in
+	// GOPRIVATE syntax, matched against the requested path.
+	Pattern string `koanf:"pattern" json:"pattern"`
+
+	// Versions is a semver range such as ">=v1.2.0, <v1.4.0 || v2.0.1".
+	// Empty matches every version.
+	Versions string `koanf:"versions" json:"versions,omitempty"`
+
+	// Reason is shown to clients when the rule denies a request.
+	Reason string `koanf:"reason" json:"reason,omitempty"`
+}
+
+// policyFile is the content of the policy file.
+type policyFile struct {
+	// Default is the action when no rule matches: "allow" (a denylist)
+	// or "deny" (an allowlist). Defaults to "allow".
+	Default string       `koanf:"default" json:"default"`
+	Rules   []PolicyRule `koanf:"rules" json:"rules"`
+}
+
+// policy decides which modules and versions are served. Rules are tried in
+// order and the first match wins. They are loaded from their own file so
+// that they can be reloaded without a restart.
+type policy struct {
+	file   string
+	logger *slog.Logger
+
+	current atomic.Pointer[compiledPolicy]
+}
+
+type compiledPolicy struct {
+	policyFile
+	allow bool
+	rules []policyRule
+}
+
+type policyRule struct {
+	PolicyRule
+	allow bool
+	// versions is nil when the rule matches every version.
+	versions versionRange
+}
+
+// deniedError is returned for requests denied by the policy. It wraps
+// fs.ErrNotExist so that goproxy answers with its message.
+type deniedError struct {
+	msg string
+}
+
+func (e *deniedError) Error() string { return e.msg }
+
+func (e *deniedError) Is(target error) bool {
+	return target == errDenied || target == fs.ErrNotExist
+}
+
+func newPolicy(file string, logger *slog.Logger) (*policy, error) {
+	if file == "" {
+		return nil, fmt.Errorf("missing policy file")
+	}
+	p := &policy{file: file, logger: logger}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reload loads the policy file again. The current rules are kept if it is
+// invalid.
+func (p *policy) reload() error {
+	ko := koanf.New(".")
+	if err := ko.Load(file.Provider(p.file), toml.Parser()); err != nil {
+		policyReloadErrorsTotal.Inc()
+		return fmt.Errorf("failed to load policy file: %w", err)
+	}
+	var pf policyFile
+	if err := ko.Unmarshal("", &pf); err != nil {
+		policyReloadErrorsTotal.Inc()
+		return fmt.Errorf("failed to parse policy file: %w", err)
+	}
+	c, err := compilePolicy(pf)
+	if err != nil {
+		policyReloadErrorsTotal.Inc()
+		return fmt.Errorf("invalid policy file %s: %w", p.file, err)
+	}
+
+	p.current.Store(c)
+	p.logger.Info("Loaded module policy", "file", p.file, "default", c.Default, "rules", len(c.rules))
+	return nil
+}
+
+func compilePolicy(pf policyFile) (*compiledPolicy, error) {
+	if pf.Default == "" {
+		pf.Default = policyAllow
+	}
+	if pf.Default != policyAllow && pf.Default != policyDeny {
+		return nil, fmt.Errorf("default must be %q or %q", policyAllow, policyDeny)
+	}
+
+	c := &compiledPolicy{policyFile: pf, allow: pf.Default == policyAllow}
+	for i, r := range pf.Rules {
+		if r.Action != policyAllow && r.Action != policyDeny {
+			return nil, fmt.Errorf("rule %d: action must be %q or %q", i+1, policyAllow, policyDeny)
+		}
+		if r.Pattern == "" {
+			return nil, fmt.Errorf("rule %d: missing pattern", i+1)
+		}
+		if err := validatePatterns(r.Pattern); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		versions, err := parseVersionRange(r.Versions)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid versions: %w", i+1, err)
+		}
+		c.rules = append(c.rules, policyRule{PolicyRule: r, allow: r.Action == policyAllow, versions: versions})
+	}
+	return c, nil
+}
+
+// rules returns the policy currently in effect.
+func (p *policy) rules() policyFile {
+	return p.current.Load().policyFile
+}
+
+// decide returns the rule that applies to a version of a module, or nil if
+// the default applies. An empty version asks about the module as a whole: it
+// is allowed if any of its versions may be.
+func (c *compiledPolicy) decide(path, version string) (rule *policyRule, allow bool) {
+	for i := range c.rules {
+		r := &c.rules[i]
+		if !module.MatchPrefixPatterns(r.Pattern, path) {
+			continue
+		}
+		switch {
+		case r.versions == nil:
+			return r, r.allow
+		case version == "":
+			if r.allow {
+				return r, true
+			}
+		case r.versions.match(version):
+			return r, r.allow
+		}
+	}
+	return nil, c.allow
+}
+
+// check returns a deniedError if the policy doesn't allow a version of a
+// module, or the module as a whole if version is empty.
+func (p *policy) check(path, version string) error {
+	if p == nil {
+		return nil
+	}
+	rule, allow := p.current.Load().decide(path, version)
+	if allow {
+		return nil
+	}
+	policyDeniedTotal.Inc()
+
+	target := path
+	if version != "" {
+		target += "@" + version
+	}
+	switch {
+	case rule == nil:
+		return &deniedError{fmt.Sprintf("%s is not allowed by the module policy", target)}
+	case rule.Reason == "":
+		return &deniedError{fmt.Sprintf("%s is denied by the module policy", target)}
+	}
+	return &deniedError{fmt.Sprintf("%s is denied by the module policy: %s", target, rule.Reason)}
+}
+
+// filter returns the versions of a module that the policy allows.
+func (p *policy) filter(path string, versions []string) []string {
+	if p == nil {
+		return versions
+	}
+	c := p.current.Load()
+	allowed := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if _, ok := c.decide(path, v); ok {
+			allowed = append(allowed, v)
+		}
+	}
+	return allowed
+}
+
+// versionRange is a semver range: any of a list of constraint sets, each
+// matching when all of its constraints do.
+type versionRange [][]versionConstraint
+
+type versionConstraint struct {
+	op      string
+	version string
+}
+
+// versionOps are the constraint operators, longest first.
+var versionOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// parseVersionRange parses constraints such as ">=v1.2.0, <v1.4.0". They are
+// separated by commas or spaces, and alternatives by "||". A version without
+// an operator matches exactly. The "v" prefix is optional.
+func parseVersionRange(s string) (versionRange, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var vr versionRange
+	for _, alt := range strings.Split(s, "||") {
+		fields := strings.FieldsFunc(alt, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty alternative in %q", s)
+		}
+
+		var all []versionConstraint
+		for i := 0; i < len(fields); i++ {
+			f, op := fields[i], "="
+			for _, o := range versionOps {
+				if strings.HasPrefix(f, o) {
+					op, f = o, f[len(o):]
+					break
+				}
+			}
+			// Allow a space between the operator and the version.
+			if f == "" && i+1 < len(fields) {
+				i++
+				f = fields[i]
+			}
+			if !strings.HasPrefix(f, "v") {
+				f = "v" + f
+			}
+			if !semver.IsValid(f) {
+				return nil, fmt.Errorf("invalid version %q", fields[i])
+			}
+			all = append(all, versionConstraint{op, f})
+		}
+		vr = append(vr, all)
+	}
+	return vr, nil
+}
+
+func (vr versionRange) match(version string) bool {
+	if !semver.IsValid(version) {
+		return false
+	}
+	for _, all := range vr {
+		ok := true
+		for _, c := range all {
+			if !c.match(version) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c versionConstraint) match(version string) bool {
+	cmp := semver.Compare(version, c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp == 0
+}
+
+// moduleRequest returns the module path and version of a proxy request
+// path. The version is empty for lists, @latest and queries that aren't
+// canonical versions.
+func moduleRequest(urlPath string) (modulePath, version string, ok bool) {
+	name := strings.TrimPrefix(urlPath, "/")
+	if p, v, _, ok := parseCacheName(name); ok {
+		if module.CanonicalVersion(v) != v {
+			v = ""
+		}
+		return p, v, true
+	}
+
+	escapedPath, ok := strings.CutSuffix(name, "/@v/list")
+	if !ok {
+		escapedPath, ok = strings.CutSuffix(name, "/@latest")
+	}
+	if !ok {
+		return "", "", false
+	}
+	modulePath, err := module.UnescapePath(escapedPath)
+	if err != nil {
+		return "", "", false
+	}
+	return modulePath, "", true
+}
+
+// deniedKey is the context key of the reason set when a request was denied.
+type deniedKey struct{}
+
+// withDeniedFlag returns a context that can be marked as denied.
+func withDeniedFlag(ctx context.Context) (context.Context, *atomic.Pointer[string]) {
+	reason := &atomic.Pointer[string]{}
+	return context.WithValue(ctx, deniedKey{}, reason), reason
+}
+
+// markDenied flags the request of ctx if err is errDenied, so that it is
+// answered with 403 instead of goproxy's 404, or instead of the cached
+// response goproxy falls back to.
+func markDenied(ctx context.Context, err error) {
+	if !errors.Is(err, errDenied) {
+		return
+	}
+	if reason, ok := ctx.Value(deniedKey{}).(*atomic.Pointer[string]); ok {
+		msg := err.Error()
+		reason.Store(&msg)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestModuleRequest(t *testing.T) {
+	tests := []struct {
+		urlPath             string
+		modulePath, version string
+		ok                  bool
+	}{
+		{"/example.com/m/@v/v1.2.3.zip", "example.com/m", "v1.2.3", true},
+		{"/example.com/m/@v/v1.2.3.info", "example.com/m", "v1.2.3", true},
+		{"/github.com/docker/docker/@v/v20.10.7+incompatible.zip", "github.com/docker/docker", "v20.10.7+incompatible", true},
+		{"/github.com/docker/docker/@v/v20.10.7+incompatible.mod", "github.com/docker/docker", "v20.10.7+incompatible", true},
+		{"/example.com/m/@v/v1.info", "example.com/m", "", true},
+		{"/example.com/m/@v/master.info", "example.com/m", "", true},
+		{"/example.com/m/@v/list", "example.com/m", "", true},
+		{"/example.com/m/@latest", "example.com/m", "", true},
+		{"/github.com/!azure/sdk/@v/v1.0.0.mod", "github.com/Azure/sdk", "v1.0.0", true},
+		{"/sumdb/sum.golang.org/latest", "", "", false},
+	}
+	for _, tt := range tests {
+		modulePath, version, ok := moduleRequest(tt.urlPath)
+		if modulePath != tt.modulePath || version != tt.version || ok != tt.ok {
+			t.Errorf("moduleRequest(%s) = %q, %q, %v, want %q, %q, %v", tt.urlPath, modulePath, version, ok, tt.modulePath, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestPolicyDeniesIncompatibleVersions(t *testing.T) {
+	c, err := compilePolicy(policyFile{Rules: []PolicyRule{
+		{Action: policyDeny, Pattern: "github.com/docker/docker", Versions: "<v21.0.0", Reason: "vulnerable"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pol := &policy{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	pol.current.Store(c)
+	p := &Proxy{cfg: &Config{}, fetcher: &fetcher{policy: pol}, logger: pol.logger}
+
+	// Denied versions are refused before the cache is looked at, so the
+	// proxy's goproxy handler is never reached.
+	for _, name := range []string{"v20.10.7+incompatible.zip", "v20.10.7+incompatible.info", "v20.10.7+incompatible.mod"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/github.com/docker/docker/@v/"+name, nil))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s = %d, want 403", name, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// privateSumDB is a checksum database for private modules. It is a signed,
+// append-only transparency log that records the h1: hashes of every module
+// version the first time toru serves it. The go command can verify against it
+// with GOSUMDB="<name>+<key> <url>". Since GOSUMDB names a single database,
+// public modules are recorded too, after being verified upstream.
+//
+// The log is kept in memory and persisted as JSON lines in a directory, so
+// it is rebuilt from disk on startup.
+type privateSumDB struct {
+	name     string
+	prefix   string
+	signer   note.Signer
+	verifier string
+	server   *sumdb.Server
+	logger   *slog.Logger
+
+	// download fetches a module version that has not been recorded yet.
+	// Downloading records it as a side effect.
+	download func(ctx context.Context, path, version string) error
+
+	mu      sync.Mutex
+	file    *os.File
+	records [][]byte
+	hashes  tlogHashes
+	lookup  map[string]int64
+}
+
+// privateSumDBRecord is a single log entry as persisted on disk.
+type privateSumDBRecord struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Zip     string `json:"zip"`
+	Mod     string `json:"mod"`
+}
+
+// text returns the record text in go.sum format, as served by a checksum
+// database.
+func (r privateSumDBRecord) text() []byte {
+	return []byte(fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", r.Path, r.Version, r.Zip, r.Path, r.Version, r.Mod))
+}
+
+// tlogHashes implements tlog.HashReader over the stored hashes.
+type tlogHashes []tlog.Hash
+
+func (h tlogHashes) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	list := make([]tlog.Hash, 0, len(indexes))
+	for _, i := range indexes {
+		if i < 0 || i >= int64(len(h)) {
+			return nil, fmt.Errorf("hash index %d out of range", i)
+		}
+		list = append(list, h[i])
+	}
+	return list, nil
+}
+
+var _ = sumdb.ServerOps(&privateSumDB{})
+
+func newPrivateSumDB(cfg *Config, logger *slog.Logger) (*privateSumDB, error) {
+	c := cfg.PrivateSumDB
+	if c.Name == "" {
+		return nil, fmt.Errorf("missing private sumdb name")
+	}
+	if c.Path == "" {
+		return nil, fmt.Errorf("missing private sumdb path")
+	}
+	if err := os.MkdirAll(c.Path, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create private sumdb directory: %w", err)
+	}
+
+	skey, err := loadOrCreateSumDBKey(c.Path, c.Name, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private sumdb key: %w", err)
+	}
+	if signer.Name() != c.Name {
+		return nil, fmt.Errorf("private sumdb key is for %q, not %q", signer.Name(), c.Name)
+	}
+	vkey, err := verifierKey(skey)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &privateSumDB{
+		name:     c.Name,
+		prefix:   "/sumdb/" + c.Name,
+		signer:   signer,
+		verifier: vkey,
+		logger:   logger,
+		lookup:   make(map[string]int64),
+	}
+	db.server = sumdb.NewServer(db)
+
+	if err := db.load(filepath.Join(c.Path, "records.jsonl")); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Private checksum database ready",
+		"name", db.name,
+		"records", len(db.records),
+		"gosumdb", db.verifier,
+	)
+
+	return db, nil
+}
+
+// loadOrCreateSumDBKey returns the configured signer key, or the one stored in
+// dir. If neither exists a new key is generated and saved.
+func loadOrCreateSumDBKey(dir, name, key string) (string, error) {
+	if key != "" {
+		return key, nil
+	}
+
+	keyFile := filepath.Join(dir, "signer.key")
+	b, err := os.ReadFile(keyFile)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to read private sumdb key: %w", err)
+	}
+
+	skey, _, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate private sumdb key: %w", err)
+	}
+	if err := os.WriteFile(keyFile, []byte(skey+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to save private sumdb key: %w", err)
+	}
+	return skey, nil
+}
+
+// verifierKey derives the public verifier key from a signer key
+// ("PRIVATE+KEY+<name>+<hash>+<base64 key>").
+func verifierKey(skey string) (string, error) {
+	parts := strings.SplitN(skey, "+", 5)
+	if len(parts) != 5 || parts[0] != "PRIVATE" || parts[1] != "KEY" {
+		return "", fmt.Errorf("malformed private sumdb key")
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) != 1+ed25519.SeedSize || key[0] != 1 {
+		return "", fmt.Errorf("malformed private sumdb key")
+	}
+
+	pub := ed25519.NewKeyFromSeed(key[1:]).Public().(ed25519.PublicKey)
+	return note.NewEd25519VerifierKey(parts[2], pub)
+}
+
+// load replays the persisted log and opens it for appending.
+func (db *privateSumDB) load(file string) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open private sumdb log: %w", err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec privateSumDBRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			f.Close()
+			return fmt.Errorf("corrupt private sumdb log entry %d: %w", len(db.records), err)
+		}
+		if err := db.append(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to read private sumdb log: %w", err)
+	}
+
+	db.file = f
+	return nil
+}
+
+// append adds a record to the in-memory log. The caller must hold db.mu or
+// own db exclusively.
+func (db *privateSumDB) append(rec privateSumDBRecord) error {
+	id := int64(len(db.records))
+	data := rec.text()
+	hashes, err := tlog.StoredHashesForRecordHash(id, tlog.RecordHash(data), db.hashes)
+	if err != nil {
+		return fmt.Errorf("failed to hash private sumdb record: %w", err)
+	}
+
+	db.records = append(db.records, data)
+	db.hashes = append(db.hashes, hashes...)
+	db.lookup[rec.Path+"@"+rec.Version] = id
+	return nil
+}
+
+// record adds the sums of a module version to the log, or checks them
+// against the existing record. A mismatch means the module changed upstream
+// after it was first served.
+func (db *privateSumDB) record(path, version string, sums moduleSums) error {
+	rec := privateSumDBRecord{Path: path, Version: version, Zip: sums.Zip, Mod: sums.Mod}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if id, ok := db.lookup[path+"@"+version]; ok {
+		if !bytes.Equal(db.records[id], rec.text()) {
+			return fmt.Errorf("%w: %w: %s@%s does not match private checksum database record %d", fs.ErrNotExist, ErrChecksumMismatch, path, version, id)
+		}
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := db.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to persist private sumdb record: %w", err)
+	}
+	if err := db.file.Sync(); err != nil {
+		return fmt.Errorf("failed to persist private sumdb record: %w", err)
+	}
+	if err := db.append(rec); err != nil {
+		return err
+	}
+
+	privateSumDBRecordsTotal.Inc()
+	db.logger.Info("Recorded module in private checksum database", "module", path, "version", version, "id", len(db.records)-1)
+	return nil
+}
+
+// ServeHTTP serves the checksum database protocol under /sumdb/<name>/, which
+// is where the go command looks for a sumdb proxied by GOPROXY.
+func (db *privateSumDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, db.prefix)
+	if path == "/supported" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = path
+	db.server.ServeHTTP(w, r2)
+}
+
+// Signed implements sumdb.ServerOps.
+func (db *privateSumDB) Signed(ctx context.Context) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	size := int64(len(db.records))
+	h, err := tlog.TreeHash(size, db.hashes)
+	if err != nil {
+		return nil, err
+	}
+	text := tlog.FormatTree(tlog.Tree{N: size, Hash: h})
+	return note.Sign(&note.Note{Text: string(text)}, db.signer)
+}
+
+// ReadRecords implements sumdb.ServerOps.
+func (db *privateSumDB) ReadRecords(ctx context.Context, id, n int64) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if id < 0 || id+n > int64(len(db.records)) {
+		return nil, fmt.Errorf("missing records")
+	}
+	return db.records[id : id+n], nil
+}
+
+// Lookup implements sumdb.ServerOps. Versions that have not been served yet
+// are downloaded, which records them.
+func (db *privateSumDB) Lookup(ctx context.Context, m module.Version) (int64, error) {
+	key := m.Path + "@" + m.Version
+	db.mu.Lock()
+	id, ok := db.lookup[key]
+	db.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	if db.download == nil {
+		return 0, fs.ErrNotExist
+	}
+	if err := db.download(ctx, m.Path, m.Version); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if id, ok := db.lookup[key]; ok {
+		return id, nil
+	}
+	return 0, fs.ErrNotExist
+}
+
+// ReadTileData implements sumdb.ServerOps.
+func (db *privateSumDB) ReadTileData(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return tlog.ReadTileData(t, db.hashes)
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/goproxy/goproxy"
@@ -13,10 +18,18 @@ import (
 
 type Proxy struct {
 	client         *goproxy.Goproxy
+	fetcher        *fetcher
+	cache          cacheStore
 	cfg            *Config
 	logger         *slog.Logger
 	server         *http.Server
 	authenticators map[string]Authenticator
+
+	// goGet serves vanity import meta tags. It is nil when disabled.
+	goGet *goGet
+
+	// sumdbs proxies public checksum databases. It is nil when disabled.
+	sumdbs *sumdbProxy
 }
 
 func newProxy(cfg *Config, logger *slog.Logger) (*Proxy, error) {
@@ -27,29 +40,26 @@ func newProxy(cfg *Config, logger *slog.Logger) (*Proxy, error) {
 		KeepAlive: 30 * time.Second,
 	}).DialContext
 
-	fetcher, err := newFetcher(cfg, logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create fetcher: %w", err)
-	}
-
-	var cacher goproxy.Cacher
+	var (
+		cache cacheStore
+		err   error
+	)
 	if cfg.Cache.Enabled {
-		switch cfg.Cache.Type {
-		case "s3":
-			cacher, err = newS3Cacher(cfg)
-		case "disk":
-			cacher = goproxy.DirCacher(cfg.Cache.Disk.Path)
-		default:
-			return nil, fmt.Errorf("unsupported cache type: %s", cfg.Cache.Type)
-		}
+		store, err := newCacheStore(cfg)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create cacher: %w", err)
 		}
+		cache = newCoalescingCache(store)
+	}
+
+	fetcher, err := newFetcher(cfg, cache, transport, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fetcher: %w", err)
 	}
 
 	client := &goproxy.Goproxy{
 		Fetcher:   fetcher,
-		Cacher:    cacher,
+		Cacher:    cache,
 		Transport: transport,
 	}
 
@@ -79,12 +89,28 @@ func newProxy(cfg *Config, logger *slog.Logger) (*Proxy, error) {
 		}
 	}
 
+	var gg *goGet
+	if cfg.GoGet.Enabled {
+		if gg, err = newGoGet(cfg, fetcher.rules, logger); err != nil {
+			return nil, fmt.Errorf("failed to create go-get handler: %w", err)
+		}
+	}
+
+	sumdbs, err := newSumdbProxy(cfg, cache, transport, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sumdb proxy: %w", err)
+	}
+
 	return &Proxy{
 		client:         client,
+		fetcher:        fetcher,
+		cache:          cache,
 		cfg:            cfg,
 		logger:         logger,
 		server:         server,
 		authenticators: authenticators,
+		goGet:          gg,
+		sumdbs:         sumdbs,
 	}, nil
 }
 
@@ -106,6 +132,14 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"remote_addr", r.RemoteAddr,
 	)
 
+	// The go command doesn't send credentials when resolving vanity
+	// import paths, and the meta tags only reveal the configured mapping.
+	if p.goGet != nil && isGoGet(r) {
+		p.goGet.ServeHTTP(w, r)
+		requestDuration.UpdateDuration(startTime)
+		return
+	}
+
 	if p.cfg.Auth.Enabled {
 		// Extract credentials from the request
 		authMethod, password, ok := r.BasicAuth()
@@ -139,10 +173,76 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Wrap the ResponseWriter to capture the response size
-	rw := &responseWriter{ResponseWriter: w}
+	// Denied modules and versions are refused before the cache or the
+	// upstream is looked at.
+	modulePath, version, isModule := moduleRequest(r.URL.Path)
+	if isModule {
+		err := p.fetcher.policy.check(modulePath, version)
+		if err == nil {
+			err = p.fetcher.toolchains.check(modulePath, version)
+		}
+		if err != nil {
+			p.logger.Info("Request denied by policy", "path", r.URL.Path, "reason", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			requestDuration.UpdateDuration(startTime)
+			return
+		}
+	}
 
-	p.client.ServeHTTP(rw, r)
+	// Wrap the ResponseWriter to capture the response size, to answer with
+	// 503 if the upstream is temporarily unavailable, with 403 if the
+	// version a query resolved to is denied, and to report vulnerabilities.
+	ctx, unavailable := withUnavailableFlag(r.Context())
+	ctx, denied := withDeniedFlag(ctx)
+	ctx, vulns := withVulnNotice(ctx)
+	r = r.WithContext(ctx)
+	rw := &responseWriter{ResponseWriter: w, unavailable: unavailable, denied: denied, vulns: vulns, retryAfter: p.cfg.Upstream.Limits.RetryAfter}
+
+	if isModule && version != "" && path.Ext(r.URL.Path) == ".zip" {
+		err := p.fetcher.checkAge(ctx, modulePath, version)
+		if err == nil {
+			err = p.fetcher.checkLicenses(ctx, modulePath, version)
+		}
+		if err == nil {
+			err = p.fetcher.vulns.check(ctx, modulePath, version, false)
+		}
+		switch {
+		case errors.Is(err, errDenied):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			requestDuration.UpdateDuration(startTime)
+			return
+		case errors.Is(err, errUnavailable):
+			writeUnavailable(w, p.cfg.Upstream.Limits.RetryAfter)
+			requestDuration.UpdateDuration(startTime)
+			return
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			// Missing versions are left to goproxy to report.
+			p.logger.Error("Failed to check module version", "path", r.URL.Path, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			requestDuration.UpdateDuration(startTime)
+			return
+		}
+		// Retractions are only reported, so reading them may not hold
+		// up the download.
+		if p.fetcher.retractions != nil {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+				defer cancel()
+				p.fetcher.noteRetracted(ctx, modulePath, version)
+			}()
+		}
+	}
+
+	// The private checksum database is served under the sumdb proxy path
+	// so the go command finds it through GOPROXY, next to the proxied
+	// public ones.
+	handler := http.Handler(p.client)
+	if sdb := p.fetcher.checksums.private; sdb != nil && strings.HasPrefix(r.URL.Path, sdb.prefix+"/") {
+		handler = sdb
+	} else if p.sumdbs.handles(r.URL.Path) {
+		handler = p.sumdbs
+	}
+	handler.ServeHTTP(rw, r)
 
 	requestDuration.UpdateDuration(startTime)
 	responseSize.Update(float64(rw.size))
@@ -152,9 +252,57 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type responseWriter struct {
 	http.ResponseWriter
 	size int
+
+	// unavailable is set when the request failed because of
+	// errUnavailable. goproxy reports it as a 500, which is replaced with
+	// a 503.
+	unavailable *atomic.Bool
+	retryAfter  time.Duration
+	discard     bool
+
+	// denied is set to the reason the request was denied. goproxy
+	// reports it as a 404, which is turned into a 403. When a query
+	// fails, goproxy serves the cached response instead, such as the
+	// previous @latest: it is replaced with a 403 too, so that it can't
+	// bypass the denial.
+	denied *atomic.Pointer[string]
+
+	// vulns is set to the vulnerabilities of the served version.
+	vulns       *atomic.Pointer[string]
+	wroteHeader bool
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.wroteHeader = true
+	if reason := rw.denied.Load(); reason != nil && code < 400 {
+		for _, h := range []string{"Cache-Control", "ETag", "Last-Modified", "Content-Length"} {
+			rw.Header().Del(h)
+		}
+		http.Error(rw.ResponseWriter, *reason, http.StatusForbidden)
+		rw.discard = true
+		return
+	}
+	if ids := rw.vulns.Load(); ids != nil && code < 300 {
+		rw.Header().Set(vulnHeader, *ids)
+	}
+	if code == http.StatusInternalServerError && rw.unavailable.Load() {
+		writeUnavailable(rw.ResponseWriter, rw.retryAfter)
+		rw.discard = true
+		return
+	}
+	if code == http.StatusNotFound && rw.denied.Load() != nil {
+		code = http.StatusForbidden
+	}
+	rw.ResponseWriter.WriteHeader(code)
 }
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.discard {
+		return len(b), nil
+	}
 	n, err := rw.ResponseWriter.Write(b)
 	rw.size += n
 	return n, err
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseWriterDenied(t *testing.T) {
+	tests := []struct {
+		name     string
+		denied   bool
+		code     int
+		wantCode int
+		wantBody string
+	}{
+		{"allowed", false, http.StatusOK, http.StatusOK, `{"Version":"v1.1.0"}`},
+		{"denied query", true, http.StatusNotFound, http.StatusForbidden, "not found\n"},
+		{"cached response of a denied query", true, http.StatusOK, http.StatusForbidden, "example.com/m@v1.1.0 is denied\n"},
+		{"revalidated response of a denied query", true, http.StatusNotModified, http.StatusForbidden, "example.com/m@v1.1.0 is denied\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, unavailable := withUnavailableFlag(context.Background())
+			ctx, denied := withDeniedFlag(ctx)
+			_, vulns := withVulnNotice(ctx)
+			if tt.denied {
+				markDenied(ctx, &deniedError{"example.com/m@v1.1.0 is denied"})
+			}
+			markDenied(ctx, errors.New("not a denial"))
+
+			rec := httptest.NewRecorder()
+			rw := &responseWriter{ResponseWriter: rec, unavailable: unavailable, denied: denied, vulns: vulns}
+			rw.Header().Set("Cache-Control", "public, max-age=60")
+			if tt.code == http.StatusOK {
+				rw.WriteHeader(tt.code)
+				rw.Write([]byte(`{"Version":"v1.1.0"}`))
+			} else {
+				http.Error(rw, "not found", tt.code)
+			}
+
+			if rec.Code != tt.wantCode || rec.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", rec.Code, rec.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if tt.denied && tt.code < 400 && rec.Header().Get("Cache-Control") != "" {
+				t.Errorf("denied response is cacheable: %s", rec.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// proxyClient fetches modules from a GOPROXY list by speaking the module
+// proxy protocol over HTTP. Only "direct" entries and modules matching
+// noProxy go through the go command.
+type proxyClient struct {
+	proxies []proxyEntry
+	noProxy string
+	client  *http.Client
+	direct  goproxy.Fetcher
+	limits  *limiter
+	retry   *retrier
+}
+
+// proxyEntry is an element of a GOPROXY list: a proxy URL, "direct" or "off".
+type proxyEntry struct {
+	url string
+
+	// host is the host of url, used to limit concurrent fetches.
+	host string
+
+	// anyError is set if the entry is followed by '|', in which case the
+	// next entry is tried on any error, not only on 404 and 410.
+	anyError bool
+}
+
+// errProxyOff is returned for modules that can't be fetched because of an
+// "off" GOPROXY entry.
+var errProxyOff = fmt.Errorf("%w: module lookup disabled by GOPROXY=off", fs.ErrNotExist)
+
+var _ = goproxy.Fetcher(&proxyClient{})
+
+// newProxyClient creates a client for a GOPROXY list. The list must have
+// been validated with validateGOPROXY.
+func newProxyClient(list, noProxy string, client *http.Client, direct goproxy.Fetcher, limits *limiter, retry *retrier) *proxyClient {
+	c := &proxyClient{noProxy: noProxy, client: client, direct: direct, limits: limits, retry: retry}
+	for list != "" {
+		i := strings.IndexAny(list, ",|")
+		e := proxyEntry{url: list}
+		if i >= 0 {
+			e = proxyEntry{url: list[:i], anyError: list[i] == '|'}
+			list = list[i+1:]
+		} else {
+			list = ""
+		}
+		e.url = strings.TrimSuffix(strings.TrimSpace(e.url), "/")
+		if u, err := url.Parse(e.url); err == nil {
+			e.host = u.Host
+		}
+		c.proxies = append(c.proxies, e)
+	}
+	return c
+}
+
+// walk tries each proxy entry in turn until one succeeds or fails in a way
+// that doesn't allow falling back. Every call is retried and limited per
+// upstream host.
+func (c *proxyClient) walk(ctx context.Context, path string, proxy func(url string) error, direct func() error) error {
+	if module.MatchPrefixPatterns(c.noProxy, path) {
+		return c.limited(ctx, modulePathHost(path), direct)
+	}
+
+	err := errProxyOff
+	for _, e := range c.proxies {
+		switch e.url {
+		case "off":
+			return errProxyOff
+		case "direct":
+			err = c.limited(ctx, modulePathHost(path), direct)
+		default:
+			err = c.limited(ctx, e.host, func() error { return proxy(e.url) })
+		}
+		if err == nil || (!e.anyError && !errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+	}
+	return err
+}
+
+// limited calls fn, retrying transient errors, while holding a slot of host
+// for each attempt.
+func (c *proxyClient) limited(ctx context.Context, host string, fn func() error) error {
+	return c.retry.do(ctx, host, func() error {
+		release, err := c.limits.acquire(ctx, host)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return fn()
+	})
+}
+
+// modulePathHost returns the host of a module path, its first element.
+func modulePathHost(path string) string {
+	host, _, _ := strings.Cut(path, "/")
+	return host
+}
+
+func (c *proxyClient) Query(ctx context.Context, path, query string) (version string, t time.Time, err error) {
+	err = c.walk(ctx, path, func(proxy string) error {
+		version, t, err = c.proxyQuery(ctx, proxy, path, query)
+		return err
+	}, func() error {
+		version, t, err = c.direct.Query(ctx, path, query)
+		return err
+	})
+	return version, t, err
+}
+
+func (c *proxyClient) proxyQuery(ctx context.Context, proxy, path, query string) (string, time.Time, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return "", time.Time{}, notExist(err)
+	}
+	escapedQuery, err := module.EscapeVersion(query)
+	if err != nil {
+		return "", time.Time{}, notExist(err)
+	}
+
+	u := proxy + "/" + escapedPath + "/@v/" + escapedQuery + ".info"
+	if query == "latest" || isVersionPrefix(query) {
+		// Like the go command, resolve these from the list and only ask
+		// for @latest when there are no tagged versions.
+		versions, err := c.proxyList(ctx, proxy, path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", time.Time{}, err
+		}
+		if query != "latest" {
+			matching := versions[:0:0]
+			for _, v := range versions {
+				if strings.HasPrefix(v, query+".") {
+					matching = append(matching, v)
+				}
+			}
+			versions = matching
+		}
+		if v := latestVersion(versions); v != "" {
+			return c.proxyQuery(ctx, proxy, path, v)
+		}
+		if query != "latest" {
+			return "", time.Time{}, notExist(fmt.Errorf("no matching versions for query %q", query))
+		}
+		u = proxy + "/" + escapedPath + "/@latest"
+	}
+	b, err := c.get(ctx, u)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return parseInfo(b)
+}
+
+func (c *proxyClient) List(ctx context.Context, path string) (versions []string, err error) {
+	err = c.walk(ctx, path, func(proxy string) error {
+		versions, err = c.proxyList(ctx, proxy, path)
+		return err
+	}, func() error {
+		versions, err = c.direct.List(ctx, path)
+		return err
+	})
+	return versions, err
+}
+
+func (c *proxyClient) proxyList(ctx context.Context, proxy, path string) ([]string, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	b, err := c.get(ctx, proxy+"/"+escapedPath+"/@v/list")
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the go command, only list tagged versions.
+	versions := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && semver.IsValid(fields[0]) && !module.IsPseudoVersion(fields[0]) {
+			versions = append(versions, fields[0])
+		}
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+func (c *proxyClient) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	if err := module.Check(path, version); err != nil {
+		return nil, nil, nil, notExist(err)
+	}
+	if module.CanonicalVersion(version) != version {
+		return nil, nil, nil, notExist(fmt.Errorf("version %s is not canonical", version))
+	}
+
+	err = c.walk(ctx, path, func(proxy string) error {
+		info, mod, zip, err = c.proxyDownload(ctx, proxy, path, version)
+		return err
+	}, func() error {
+		info, mod, zip, err = c.direct.Download(ctx, path, version)
+		return err
+	})
+	return info, mod, zip, err
+}
+
+// downloadMod fetches the go.mod file of a module version. Proxies serve it
+// on its own; direct fetches download the whole version.
+func (c *proxyClient) downloadMod(ctx context.Context, path, version string) (data []byte, err error) {
+	if err := module.Check(path, version); err != nil {
+		return nil, notExist(err)
+	}
+	if module.CanonicalVersion(version) != version {
+		return nil, notExist(fmt.Errorf("version %s is not canonical", version))
+	}
+
+	err = c.walk(ctx, path, func(proxy string) error {
+		data, err = c.proxyMod(ctx, proxy, path, version)
+		return err
+	}, func() error {
+		data, err = downloadModFile(ctx, c.direct, path, version)
+		return err
+	})
+	return data, err
+}
+
+// proxyMod fetches and checks the go.mod file of a module version.
+func (c *proxyClient) proxyMod(ctx context.Context, proxy, path, version string) ([]byte, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	data, err := c.get(ctx, proxy+"/"+escapedPath+"/@v/"+escapedVersion+".mod")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := modfile.ParseLax("go.mod", data, nil); err != nil {
+		return nil, notExist(fmt.Errorf("invalid mod response: %w", err))
+	}
+	return data, nil
+}
+
+// proxyDownload fetches and checks the files of a module version. The zip is
+// stored in a temporary file, removed when it is closed.
+func (c *proxyClient) proxyDownload(ctx context.Context, proxy, path, version string) (io.ReadSeekCloser, io.ReadSeekCloser, io.ReadSeekCloser, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return nil, nil, nil, notExist(err)
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, nil, nil, notExist(err)
+	}
+	base := proxy + "/" + escapedPath + "/@v/" + escapedVersion
+
+	infoData, err := c.get(ctx, base+".info")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	infoVersion, infoTime, err := parseInfo(infoData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if infoVersion != version {
+		return nil, nil, nil, notExist(fmt.Errorf("invalid info response: version %s, want %s", infoVersion, version))
+	}
+
+	modData, err := c.get(ctx, base+".mod")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := modfile.ParseLax("go.mod", modData, nil); err != nil {
+		return nil, nil, nil, notExist(fmt.Errorf("invalid mod response: %w", err))
+	}
+
+	zipFile, err := c.getZip(ctx, base+".zip", module.Version{Path: path, Version: version})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Normalize the info file like the go command does.
+	info, err := json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{infoVersion, infoTime})
+	if err != nil {
+		zipFile.Close()
+		return nil, nil, nil, err
+	}
+
+	return &readSeekCloser{bytes.NewReader(info)}, &readSeekCloser{bytes.NewReader(modData)}, zipFile, nil
+}
+
+// getZip downloads a module zip to a temporary file and checks it.
+func (c *proxyClient) getZip(ctx context.Context, url string, m module.Version) (io.ReadSeekCloser, error) {
+	body, err := c.open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp("", "toru-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &tempFile{f}
+	if _, err := io.Copy(f, body); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	if _, err := modzip.CheckZip(m, f.Name()); err != nil {
+		tmp.Close()
+		return nil, notExist(fmt.Errorf("invalid zip response: %w", err))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// get fetches a small proxy response, such as a list, info or mod file.
+func (c *proxyClient) get(ctx context.Context, url string) ([]byte, error) {
+	body, err := c.open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", url, err)
+	}
+	return b, nil
+}
+
+// open sends a GET request to a proxy. 404 and 410 responses are reported as
+// fs.ErrNotExist with the proxy's message, as the go command does.
+func (c *proxyClient) open(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("GET %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, notExist(err)
+	}
+	return nil, &statusError{status: resp.StatusCode, err: err}
+}
+
+// isVersionPrefix reports whether query is a semantic version prefix, such as
+// "v1" or "v1.2", which selects the highest version with that prefix.
+func isVersionPrefix(query string) bool {
+	return semver.IsValid(query) && strings.Count(query, ".") < 2 &&
+		!strings.ContainsAny(query, "-+")
+}
+
+// latestVersion returns the highest release version in a sorted list, or the
+// highest pre-release if there are no releases.
+func latestVersion(versions []string) string {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if semver.Prerelease(versions[i]) == "" {
+			return versions[i]
+		}
+	}
+	if len(versions) > 0 {
+		return versions[len(versions)-1]
+	}
+	return ""
+}
+
+// parseInfo parses a .info response.
+func parseInfo(b []byte) (string, time.Time, error) {
+	var info struct {
+		Version string
+		Time    time.Time
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return "", time.Time{}, notExist(fmt.Errorf("invalid info response: %w", err))
+	}
+	if !semver.IsValid(info.Version) {
+		return "", time.Time{}, notExist(fmt.Errorf("invalid info response: invalid version %q", info.Version))
+	}
+	return info.Version, info.Time, nil
+}
+
+// notExist wraps err so that goproxy reports it as a 404 with its message.
+func notExist(err error) error {
+	return fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+}
+
+// tempFile is a temporary file removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
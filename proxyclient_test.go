@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestProxyClientDownloadMod(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/example.com/!m/@v/v1.2.0.mod" {
+			io.WriteString(w, "module example.com/M\n\nretract v1.1.0\n")
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	retry, err := newRetrier(&Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newProxyClient(srv.URL, "", srv.Client(), nil, nil, retry)
+
+	data, err := c.downloadMod(context.Background(), "example.com/M", "v1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "module example.com/M\n\nretract v1.1.0\n" {
+		t.Errorf("go.mod = %q", data)
+	}
+	if len(requests) != 1 || requests[0] != "/example.com/!m/@v/v1.2.0.mod" {
+		t.Errorf("requests = %v, want only the .mod file", requests)
+	}
+
+	if _, err := c.downloadMod(context.Background(), "example.com/M", "v1.3.0"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing version error = %v, want not exist", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// runPublish implements "toru publish [flags] <dir|zip>", which uploads a
+// module directory or zip to the publish endpoint of the admin API.
+// Directories are zipped following the go command's rules.
+func runPublish(args []string) error {
+	f := flag.NewFlagSet("publish", flag.ContinueOnError)
+	f.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: toru publish [flags] <dir|zip>")
+		fmt.Fprintln(os.Stderr, f.FlagUsages())
+	}
+	adminURL := f.String("url", "http://localhost:8889", "URL of the admin API.")
+	modulePath := f.String("module", "", "Module path. Defaults to the module directive of the directory's go.mod.")
+	version := f.String("version", "", "Version to publish, e.g. v1.2.3.")
+	username := f.String("username", os.Getenv("TORU_ADMIN__USERNAME"), "Admin API username. Defaults to $TORU_ADMIN__USERNAME.")
+	password := f.String("password", os.Getenv("TORU_ADMIN__PASSWORD"), "Admin API password. Defaults to $TORU_ADMIN__PASSWORD.")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		return fmt.Errorf("expected a single directory or zip")
+	}
+	if *version == "" {
+		return fmt.Errorf("missing --version")
+	}
+
+	src := f.Arg(0)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	var body io.ReadSeekCloser
+	if fi.IsDir() {
+		if *modulePath == "" {
+			data, err := os.ReadFile(filepath.Join(src, "go.mod"))
+			if err != nil {
+				return fmt.Errorf("failed to read module path, set --module: %w", err)
+			}
+			if *modulePath = modfile.ModulePath(data); *modulePath == "" {
+				return fmt.Errorf("go.mod has no module directive, set --module")
+			}
+		}
+		if body, err = zipDir(src, module.Version{Path: *modulePath, Version: *version}); err != nil {
+			return err
+		}
+	} else {
+		if *modulePath == "" {
+			return fmt.Errorf("missing --module")
+		}
+		if body, err = os.Open(src); err != nil {
+			return err
+		}
+	}
+	defer body.Close()
+
+	u := strings.TrimSuffix(*adminURL, "/") + "/api/publish?" + url.Values{
+		"module":  {*modulePath},
+		"version": {*version},
+	}.Encode()
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/zip")
+	req.SetBasicAuth(*username, *password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error string     `json:"error"`
+		Sums  moduleSums `json:"sums"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s: %s", resp.Status, result.Error)
+	}
+
+	fmt.Printf("Published %s@%s\n%s %s %s\n%s %s/go.mod %s\n",
+		*modulePath, *version,
+		*modulePath, *version, result.Sums.Zip,
+		*modulePath, *version, result.Sums.Mod)
+	return nil
+}
+
+// zipDir creates a module zip of a directory in a temporary file, removed
+// when it is closed.
+func zipDir(dir string, m module.Version) (io.ReadSeekCloser, error) {
+	f, err := os.CreateTemp("", "toru-publish-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &tempFile{f}
+
+	if err := modzip.CreateFromDir(f, m, dir); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to zip %s: %w", dir, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// defaultRetractionsTTL is how long the retractions of a module are kept
+// before the go.mod of its latest version is read again.
+const defaultRetractionsTTL = time.Hour
+
+// retraction is a version or range of versions retracted by the author of a
+// module.
+type retraction struct {
+	Low       string `json:"low"`
+	High      string `json:"high"`
+	Rationale string `json:"rationale,omitempty"`
+}
+
+// moduleRetractions are the retract directives of the latest version of a
+// module, which apply to all of its versions.
+type moduleRetractions struct {
+	Latest    string       `json:"latest"`
+	Retract   []retraction `json:"retract"`
+	FetchedAt time.Time    `json:"fetched_at"`
+}
+
+// retractions reads the retract directives of modules, to leave retracted
+// versions out of lists and @latest and to count requests for them.
+type retractions struct {
+	hide bool
+	ttl  time.Duration
+
+	// modules caches the retractions of modules by path.
+	modules sync.Map
+
+	// reads coalesces concurrent reads of the retractions of a module.
+	reads flightGroup[*moduleRetractions]
+}
+
+// newRetractions returns nil if retractions are disabled.
+func newRetractions(cfg *Config) (*retractions, error) {
+	c := cfg.Retractions
+	if !c.Enabled {
+		return nil, nil
+	}
+	if c.TTL < 0 {
+		return nil, fmt.Errorf("invalid retractions ttl: can't be negative")
+	}
+	r := &retractions{hide: c.Hide, ttl: c.TTL, reads: flightGroup[*moduleRetractions]{op: "retractions"}}
+	if r.ttl == 0 {
+		r.ttl = defaultRetractionsTTL
+	}
+	return r, nil
+}
+
+// retracted returns the retraction covering a version, if any.
+func (m *moduleRetractions) retracted(version string) (retraction, bool) {
+	for _, r := range m.Retract {
+		if semver.Compare(r.Low, version) <= 0 && semver.Compare(version, r.High) <= 0 {
+			return r, true
+		}
+	}
+	return retraction{}, false
+}
+
+// retractionsOf returns the retractions of a module, read from the go.mod of
+// the latest of its upstream versions. Modules without tagged versions have
+// none.
+func (f *fetcher) retractionsOf(ctx context.Context, path string) (*moduleRetractions, error) {
+	if m, ok := f.retractions.modules.Load(path); ok {
+		if m := m.(*moduleRetractions); time.Since(m.FetchedAt) < f.retractions.ttl {
+			return m, nil
+		}
+	}
+
+	return f.retractions.reads.do(ctx, path, func(ctx context.Context) (*moduleRetractions, error) {
+		return f.readRetractions(ctx, path)
+	})
+}
+
+// readRetractions reads the retract directives of the latest version of a
+// module.
+func (f *fetcher) readRetractions(ctx context.Context, path string) (*moduleRetractions, error) {
+	versions, err := f.upstreamList(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	versions = slices.Clone(versions)
+	semver.Sort(versions)
+
+	m := &moduleRetractions{Latest: latestVersion(versions), Retract: []retraction{}, FetchedAt: time.Now()}
+	if m.Latest != "" {
+		data, err := f.modFile(ctx, path, m.Latest)
+		if err != nil {
+			return nil, err
+		}
+		file, err := modfile.ParseLax("go.mod", data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse go.mod of %s@%s: %w", path, m.Latest, err)
+		}
+		for _, r := range file.Retract {
+			m.Retract = append(m.Retract, retraction{Low: r.Low, High: r.High, Rationale: r.Rationale})
+		}
+	}
+	f.retractions.modules.Store(path, m)
+	return m, nil
+}
+
+// modFile returns the .mod file of a version, from the cache if it is there.
+// Otherwise only the .mod file is fetched from upstream, and it isn't cached:
+// it hasn't been checked like downloads are. Its module directive isn't
+// rewritten either, as only its retract directives are read.
+func (f *fetcher) modFile(ctx context.Context, path, version string) ([]byte, error) {
+	if f.cache != nil {
+		key, err := cacheKey(path, version)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := f.cache.Get(ctx, key+".mod")
+		if err == nil {
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return f.upstream.downloadMod(ctx, f.rewrite(path), version)
+}
+
+// filterRetracted leaves out the retracted versions of a module when they
+// are hidden. Retractions that can't be read are logged and ignored, as they
+// are advisory.
+func (f *fetcher) filterRetracted(ctx context.Context, path string, versions []string) []string {
+	if f.retractions == nil || !f.retractions.hide || len(versions) == 0 {
+		return versions
+	}
+	m, err := f.retractionsOf(ctx, path)
+	if err != nil {
+		f.logger.Warn("Failed to read retractions, not hiding them", "module", path, "error", err)
+		return versions
+	}
+
+	shown := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if _, ok := m.retracted(v); !ok {
+			shown = append(shown, v)
+		}
+	}
+	return shown
+}
+
+// latestUnretracted returns the latest version of a module that isn't
+// retracted, for @latest queries resolving to a retracted one. As with the
+// go command, the retracted version is kept if every version is retracted.
+func (f *fetcher) latestUnretracted(ctx context.Context, path, version string, t time.Time) (string, time.Time, error) {
+	if f.retractions == nil || !f.retractions.hide {
+		return version, t, nil
+	}
+	m, err := f.retractionsOf(ctx, path)
+	if err != nil {
+		f.logger.Warn("Failed to read retractions, not hiding them", "module", path, "error", err)
+		return version, t, nil
+	}
+	if _, ok := m.retracted(version); !ok {
+		return version, t, nil
+	}
+
+	versions, err := f.List(ctx, path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	versions = slices.Clone(versions)
+	semver.Sort(versions)
+	latest := latestVersion(versions)
+	if latest == "" {
+		return version, t, nil
+	}
+	r, err := f.queries.do(ctx, path+"@"+latest, func(ctx context.Context) (queryResult, error) {
+		version, t, err := f.query(ctx, path, latest)
+		return queryResult{version, t}, err
+	})
+	return r.version, r.time, err
+}
+
+// noteRetracted counts and logs a request for a retracted version.
+func (f *fetcher) noteRetracted(ctx context.Context, path, version string) {
+	if f.retractions == nil {
+		return
+	}
+	m, err := f.retractionsOf(ctx, path)
+	if err != nil {
+		f.logger.Debug("Failed to read retractions", "module", path, "error", err)
+		return
+	}
+	if r, ok := m.retracted(version); ok {
+		retractedRequestsTotal.Inc()
+		f.logger.Info("Serving retracted module version", "module", path, "version", version, "rationale", r.Rationale)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Upstream error classes, used in metrics and to decide what to retry.
+const (
+	errClassNotFound    = "not_found"
+	errClassTimeout     = "timeout"
+	errClassServer      = "server"
+	errClassAuth        = "auth"
+	errClassNetwork     = "network"
+	errClassUnavailable = "unavailable"
+	errClassCanceled    = "canceled"
+	errClassOther       = "other"
+)
+
+// statusError is an unexpected HTTP status from an upstream proxy.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+// classifyError returns the class of an upstream error.
+func classifyError(err error) string {
+	var (
+		status *statusError
+		netErr net.Error
+	)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errClassNotFound
+	case errors.Is(err, errUnavailable):
+		return errClassUnavailable
+	case errors.Is(err, context.Canceled):
+		return errClassCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return errClassTimeout
+	case errors.As(err, &status):
+		switch {
+		case status.status == 401 || status.status == 403:
+			return errClassAuth
+		case status.status == 429 || status.status >= 500:
+			return errClassServer
+		}
+		return errClassOther
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return errClassTimeout
+		}
+		return errClassNetwork
+	}
+
+	// Direct fetches only report the output of the go command and git.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "terminal prompts disabled"),
+		strings.Contains(msg, "Authentication failed"),
+		strings.Contains(msg, "could not read Username"):
+		return errClassAuth
+	case strings.Contains(msg, "timed out"):
+		return errClassTimeout
+	case strings.Contains(msg, "Could not resolve host"),
+		strings.Contains(msg, "Connection refused"),
+		strings.Contains(msg, "Connection reset"):
+		return errClassNetwork
+	case strings.Contains(msg, "The requested URL returned error: 5"):
+		return errClassServer
+	}
+	return errClassOther
+}
+
+// isRetriable reports whether an error class is likely to be transient.
+func isRetriable(class string) bool {
+	switch class {
+	case errClassTimeout, errClassServer, errClassNetwork:
+		return true
+	}
+	return false
+}
+
+// retrier retries transient upstream errors with jittered exponential
+// backoff, and keeps a circuit breaker per upstream host.
+type retrier struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+
+	threshold    int
+	openDuration time.Duration
+
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// breaker is the circuit breaker of an upstream host. It opens after
+// threshold consecutive transient failures. Once openDuration has passed a
+// single probe is let through: success closes it, failure opens it again.
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// errCircuitOpen is returned without contacting an upstream whose circuit
+// breaker is open.
+var errCircuitOpen = fmt.Errorf("%w: circuit breaker open", errUnavailable)
+
+func newRetrier(cfg *Config, logger *slog.Logger) (*retrier, error) {
+	c := cfg.Upstream.Retry
+	r := &retrier{
+		maxAttempts:  c.MaxAttempts,
+		baseDelay:    c.BaseDelay,
+		maxDelay:     c.MaxDelay,
+		threshold:    c.BreakerThreshold,
+		openDuration: c.BreakerOpenDuration,
+		logger:       logger,
+		breakers:     make(map[string]*breaker),
+	}
+	if r.maxAttempts < 0 || r.threshold < 0 || r.baseDelay < 0 || r.maxDelay < 0 || r.openDuration < 0 {
+		return nil, fmt.Errorf("invalid upstream retry config: values can't be negative")
+	}
+	if r.maxAttempts == 0 {
+		r.maxAttempts = 3
+	}
+	if r.threshold == 0 {
+		r.threshold = 5
+	}
+	if r.baseDelay == 0 {
+		r.baseDelay = 200 * time.Millisecond
+	}
+	if r.maxDelay == 0 {
+		r.maxDelay = 5 * time.Second
+	}
+	if r.openDuration == 0 {
+		r.openDuration = 30 * time.Second
+	}
+	return r, nil
+}
+
+// do calls fn until it succeeds, fails with an error that isn't transient,
+// or runs out of attempts. It fails fast while the host's breaker is open.
+func (r *retrier) do(ctx context.Context, host string, fn func() error) error {
+	label := fmt.Sprintf("{host=%q}", host)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if !r.allow(host) {
+			metrics.GetOrCreateCounter("toru_upstream_breaker_rejected_total" + label).Inc()
+			return fmt.Errorf("%w for %s", errCircuitOpen, host)
+		}
+
+		err = fn()
+		class := ""
+		if err != nil {
+			class = classifyError(err)
+			metrics.GetOrCreateCounter(fmt.Sprintf("toru_upstream_errors_by_class_total{host=%q,class=%q}", host, class)).Inc()
+		}
+		r.record(host, class)
+
+		if err == nil || !isRetriable(class) || attempt >= r.maxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		delay := r.backoff(attempt)
+		r.logger.Warn("Retrying upstream fetch", "host", host, "class", class, "attempt", attempt, "delay", delay, "error", err)
+		metrics.GetOrCreateCounter("toru_upstream_retries_total" + label).Inc()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt: exponential, capped,
+// with jitter so that retries of concurrent fetches spread out.
+func (r *retrier) backoff(attempt int) time.Duration {
+	d := r.baseDelay << (attempt - 1)
+	if d <= 0 || d > r.maxDelay {
+		d = r.maxDelay
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// allow reports whether a call to host may proceed.
+func (r *retrier) allow(host string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[host]
+	if !ok || b.failures < r.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker of host with the class of a call's error, or
+// "" if it succeeded. Only transient failures count, and calls that didn't
+// reach the upstream are ignored, except that they end a probe.
+func (r *retrier) record(host, class string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[host]
+	if class == errClassUnavailable || class == errClassCanceled {
+		// The probe didn't tell whether the host is back: let the next
+		// call probe it.
+		if ok {
+			b.probing = false
+		}
+		return
+	}
+	if !ok {
+		b = &breaker{}
+		r.breakers[host] = b
+		metrics.GetOrCreateGauge(fmt.Sprintf("toru_upstream_breaker_open{host=%q}", host), func() float64 {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if b.failures >= r.threshold {
+				return 1
+			}
+			return 0
+		})
+	}
+
+	if !isRetriable(class) {
+		if b.failures >= r.threshold {
+			r.logger.Info("Upstream circuit breaker closed", "host", host)
+		}
+		b.failures, b.probing = 0, false
+		return
+	}
+
+	b.failures++
+	if b.failures >= r.threshold {
+		if b.failures == r.threshold || b.probing {
+			r.logger.Warn("Upstream circuit breaker opened", "host", host, "duration", r.openDuration)
+			metrics.GetOrCreateCounter(fmt.Sprintf("toru_upstream_breaker_trips_total{host=%q}", host)).Inc()
+		}
+		b.openUntil = time.Now().Add(r.openDuration)
+		b.probing = false
+	}
+}
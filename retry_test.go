@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBreakerProbeNotReachingUpstream(t *testing.T) {
+	cfg := &Config{}
+	cfg.Upstream.Retry.MaxAttempts = 1
+	cfg.Upstream.Retry.BreakerThreshold = 2
+	cfg.Upstream.Retry.BreakerOpenDuration = time.Millisecond
+	r, err := newRetrier(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const host = "proxy.example.com"
+
+	errServer := &statusError{status: 502, err: errors.New("bad gateway")}
+	for range 2 {
+		r.do(ctx, host, func() error { return errServer })
+	}
+	if err := r.do(ctx, host, func() error { return nil }); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("call with the breaker open = %v, want %v", err, errCircuitOpen)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// The probes fail before reaching the upstream, so they say nothing
+	// about it: the next call probes again.
+	for _, probeErr := range []error{errOverloaded, context.Canceled} {
+		if err := r.do(ctx, host, func() error { return probeErr }); !errors.Is(err, probeErr) {
+			t.Fatalf("probe = %v, want %v", err, probeErr)
+		}
+	}
+	called := false
+	if err := r.do(ctx, host, func() error { called = true; return nil }); err != nil || !called {
+		t.Fatalf("probe after an overloaded one = %v (called %v), want a successful call", err, called)
+	}
+	if err := r.do(ctx, host, func() error { return nil }); err != nil {
+		t.Errorf("call after a successful probe = %v, want the breaker closed", err)
+	}
+}
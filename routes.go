@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/module"
+)
+
+// defaultUpstream is the metrics label of modules not matched by any route.
+const defaultUpstream = "default"
+
+// router dispatches fetches to the upstream of the first route matching the
+// module path, or to the default upstream configured under [upstream].
+type router struct {
+	routes   []*route
+	fallback *route
+	logger   *slog.Logger
+}
+
+// route is a compiled Route. fetcher is nil for blocked modules.
+type route struct {
+	pattern  string
+	upstream string
+	fetcher  goproxy.Fetcher
+}
+
+var _ = goproxy.Fetcher(&router{})
+
+func newRouter(cfg *Config, env []string, transport http.RoundTripper, hosted *hosted, logger *slog.Logger) (*router, error) {
+	limits, err := newLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetrier(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		client = &http.Client{Transport: transport}
+		// Direct fetches need the go command and a VCS.
+		direct = &goproxy.GoFetcher{
+			Env:       append(env[:len(env):len(env)], "GOPROXY=direct"),
+			Transport: transport,
+		}
+	)
+
+	rt := &router{
+		fallback: &route{
+			upstream: defaultUpstream,
+			fetcher:  newProxyClient(envValue(env, "GOPROXY"), envValue(env, "GONOPROXY"), client, direct, limits, retry),
+		},
+		logger: logger,
+	}
+
+	// Hosted modules are never fetched from upstream, whatever the routes.
+	if hosted != nil {
+		rt.routes = append(rt.routes, &route{pattern: hosted.patterns, upstream: hostedUpstream, fetcher: hosted})
+		logger.Info("Upstream route", "pattern", hosted.patterns, "upstream", hostedUpstream)
+	}
+
+	locals, err := newLocalSources(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range locals {
+		rt.routes = append(rt.routes, &route{pattern: l.Prefix, upstream: localUpstream, fetcher: l})
+	}
+
+	for i, r := range cfg.Routes {
+		if r.Pattern == "" {
+			return nil, fmt.Errorf("invalid route %d: missing pattern", i)
+		}
+		if err := validatePatterns(r.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid route %d: %w", i, err)
+		}
+
+		rr := &route{pattern: r.Pattern, upstream: r.Upstream}
+		switch r.Upstream {
+		case "":
+			return nil, fmt.Errorf("invalid route %d: missing upstream", i)
+		case "off":
+		default:
+			if err := validateGOPROXY(r.Upstream); err != nil {
+				return nil, fmt.Errorf("invalid route %d: %w", i, err)
+			}
+			// Routes apply even to GOPRIVATE modules, so nothing
+			// bypasses the route's upstream.
+			rr.fetcher = newProxyClient(r.Upstream, "", client, direct, limits, retry)
+		}
+		rt.routes = append(rt.routes, rr)
+		logger.Info("Upstream route", "pattern", rr.pattern, "upstream", rr.upstream)
+	}
+
+	return rt, nil
+}
+
+// route returns the route of a module path.
+func (rt *router) route(path string) *route {
+	for _, r := range rt.routes {
+		if module.MatchPrefixPatterns(r.pattern, path) {
+			return r
+		}
+	}
+	return rt.fallback
+}
+
+// dispatch picks the route of a module path and records its metrics. It
+// returns an error for blocked modules.
+func (rt *router) dispatch(path string) (*route, func(error), error) {
+	r := rt.route(path)
+	label := fmt.Sprintf("{upstream=%q}", r.upstream)
+	metrics.GetOrCreateCounter("toru_upstream_requests_total" + label).Inc()
+
+	if r.fetcher == nil {
+		metrics.GetOrCreateCounter("toru_upstream_blocked_total" + label).Inc()
+		return nil, nil, fmt.Errorf("%w: %s is blocked by route %q", fs.ErrNotExist, path, r.pattern)
+	}
+
+	startTime := time.Now()
+	done := func(err error) {
+		metrics.GetOrCreateSummary("toru_upstream_request_duration_seconds" + label).UpdateDuration(startTime)
+		if err != nil {
+			metrics.GetOrCreateCounter("toru_upstream_errors_total" + label).Inc()
+		}
+	}
+	if r != rt.fallback {
+		rt.logger.Debug("Routing module", "module", path, "pattern", r.pattern, "upstream", r.upstream)
+	}
+	return r, done, nil
+}
+
+func (rt *router) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	r, done, err := rt.dispatch(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	version, t, err := r.fetcher.Query(ctx, path, query)
+	done(err)
+	return version, t, err
+}
+
+func (rt *router) List(ctx context.Context, path string) ([]string, error) {
+	r, done, err := rt.dispatch(path)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := r.fetcher.List(ctx, path)
+	done(err)
+	return versions, err
+}
+
+func (rt *router) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	r, done, err := rt.dispatch(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, mod, zip, err = r.fetcher.Download(ctx, path, version)
+	done(err)
+	return info, mod, zip, err
+}
+
+// modDownloader is implemented by fetchers that can fetch the go.mod file of
+// a module version without its zip.
+type modDownloader interface {
+	downloadMod(ctx context.Context, path, version string) ([]byte, error)
+}
+
+// downloadMod fetches the go.mod file of a module version, without the zip
+// if the upstream allows it.
+func (rt *router) downloadMod(ctx context.Context, path, version string) ([]byte, error) {
+	r, done, err := rt.dispatch(path)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if md, ok := r.fetcher.(modDownloader); ok {
+		data, err = md.downloadMod(ctx, path, version)
+	} else {
+		data, err = downloadModFile(ctx, r.fetcher, path, version)
+	}
+	done(err)
+	return data, err
+}
+
+// downloadModFile downloads a module version and returns its go.mod file.
+func downloadModFile(ctx context.Context, f goproxy.Fetcher, path, version string) ([]byte, error) {
+	info, mod, zip, err := f.Download(ctx, path, version)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		info.Close()
+		mod.Close()
+		zip.Close()
+	}()
+	return io.ReadAll(mod)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// rewriteRule is a compiled RewriteRule. Every kind of rule (literal, glob
+// and regex) is compiled to a pair of anchored regular expressions, one per
+// direction, and a template that builds the other side from the captures.
+type rewriteRule struct {
+	RewriteRule
+
+	// vanityRE matches a vanity path and targetTmpl expands to the
+	// corresponding target path.
+	vanityRE   *regexp.Regexp
+	targetTmpl string
+
+	// targetRE matches a target path and vanityTmpl expands to the
+	// corresponding vanity path.
+	targetRE   *regexp.Regexp
+	vanityTmpl string
+
+	// pattern is the vanity side as a GOPRIVATE-style glob.
+	pattern string
+}
+
+// ruleSet is the list of compiled rewrite rules. Paths are mapped by the most
+// specific matching rule, so the order only matters to break ties.
+type ruleSet []*rewriteRule
+
+// templateVarRE matches $name and ${name} references in a target template.
+var templateVarRE = regexp.MustCompile(`\$(\$|\{[^}]*\}|[A-Za-z0-9_]+)`)
+
+// compileRules validates and compiles the configured rewrite rules.
+func compileRules(rules []RewriteRule) (ruleSet, error) {
+	rs := make(ruleSet, 0, len(rules))
+	for i, rule := range rules {
+		r, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %d (%s): %w", i, rule, err)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func compileRule(rule RewriteRule) (*rewriteRule, error) {
+	if rule.TargetPath == "" {
+		return nil, fmt.Errorf("missing target_path")
+	}
+
+	var (
+		pattern    string
+		targetTmpl = rule.TargetPath
+		n          int
+	)
+	if rule.VanityPath != "" {
+		n++
+		// Literal rules are templates too, so escape any '$'.
+		pattern = regexp.QuoteMeta(rule.VanityPath)
+		targetTmpl = strings.ReplaceAll(rule.TargetPath, "$", "$$")
+	}
+	if rule.VanityGlob != "" {
+		n++
+		pattern = globToRegexp(rule.VanityGlob)
+	}
+	if rule.VanityRegex != "" {
+		n++
+		pattern = rule.VanityRegex
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("exactly one of vanity_path, vanity_glob or vanity_regex is required")
+	}
+
+	if re, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("invalid vanity pattern: %w", err)
+	} else if err := checkTemplate(re, targetTmpl); err != nil {
+		return nil, err
+	}
+
+	// Rules must also map paths back, and give the GOPRIVATE pattern of
+	// their vanity paths: without them, vanity modules would be looked up
+	// in the public checksum database and their go.mod files would keep
+	// the target paths.
+	vanityTmpl, captures, exact, ok := reverseTemplate(pattern)
+	if !ok {
+		return nil, fmt.Errorf("vanity pattern can't be mapped back from target paths: use only literals and capture groups")
+	}
+	vanityRE, err := compileBounded(exact)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vanity pattern: %w", err)
+	}
+
+	r := &rewriteRule{
+		RewriteRule: rule,
+		vanityRE:    vanityRE,
+		targetTmpl:  targetTmpl,
+	}
+	r.pattern = globFromTemplate(vanityTmpl)
+	r.targetRE, r.vanityTmpl, err = reverseRule(targetTmpl, vanityTmpl, captures)
+	if err != nil {
+		return nil, err
+	}
+	if r.targetRE == nil {
+		return nil, fmt.Errorf("target_path can't be mapped back to vanity paths: it must use every group of the vanity pattern")
+	}
+
+	return r, nil
+}
+
+// checkTemplate reports an error if the template references a capture group
+// that the regular expression doesn't define.
+func checkTemplate(re *regexp.Regexp, tmpl string) error {
+	names := make(map[string]bool)
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	for _, m := range templateVarRE.FindAllStringSubmatch(tmpl, -1) {
+		name := strings.TrimSuffix(strings.TrimPrefix(m[1], "{"), "}")
+		if name == "$" {
+			continue
+		}
+		if i, err := strconv.Atoi(name); err == nil {
+			if i > re.NumSubexp() {
+				return fmt.Errorf("target_path references undefined group $%s", name)
+			}
+			continue
+		}
+		if !names[name] {
+			return fmt.Errorf("target_path references undefined group ${%s}", name)
+		}
+	}
+	return nil
+}
+
+// globToRegexp converts a glob where '*' matches a single path element into
+// a regular expression with one numbered group per '*'.
+func globToRegexp(glob string) string {
+	parts := strings.Split(glob, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return strings.Join(parts, "([^/]+)")
+}
+
+// reverseTemplate derives a template for the vanity side from its pattern.
+// This only works for patterns made of literals and capture groups; the
+// returned captures map each group reference in the template to the pattern
+// it captures. A '.' outside groups is taken as a literal dot, as in
+// "go.corp.com/(?P<repo>[^/]+)", and exact is the pattern matching only a dot
+// there, so that paths map back to what they were mapped from.
+func reverseTemplate(pattern string) (tmpl string, captures map[string]string, exact string, ok bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", nil, "", false
+	}
+	re = re.Simplify()
+
+	var (
+		b, e  strings.Builder
+		nodes = []*syntax.Regexp{re}
+	)
+	captures = make(map[string]string)
+	if re.Op == syntax.OpConcat {
+		nodes = re.Sub
+	}
+	for _, node := range nodes {
+		switch node.Op {
+		case syntax.OpLiteral:
+			if node.Flags&syntax.FoldCase != 0 {
+				return "", nil, "", false
+			}
+			b.WriteString(strings.ReplaceAll(string(node.Rune), "$", "$$"))
+			e.WriteString(regexp.QuoteMeta(string(node.Rune)))
+		case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+			b.WriteString(".")
+			e.WriteString(`\.`)
+		case syntax.OpCapture:
+			name := node.Name
+			if name == "" {
+				name = strconv.Itoa(node.Cap)
+			}
+			captures[name] = node.Sub[0].String()
+			b.WriteString("${" + name + "}")
+			if node.Name != "" {
+				e.WriteString("(?P<" + node.Name + ">" + captures[name] + ")")
+			} else {
+				e.WriteString("(" + captures[name] + ")")
+			}
+		case syntax.OpEmptyMatch:
+		default:
+			return "", nil, "", false
+		}
+	}
+	return b.String(), captures, e.String(), true
+}
+
+// globFromTemplate turns a template into a glob by replacing every group
+// reference with '*'.
+func globFromTemplate(tmpl string) string {
+	return templateVarRE.ReplaceAllStringFunc(tmpl, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		return "*"
+	})
+}
+
+// reverseRule builds the regular expression matching target paths, with
+// the template that expands them back to vanity paths.
+func reverseRule(targetTmpl, vanityTmpl string, captures map[string]string) (*regexp.Regexp, string, error) {
+	var (
+		b      strings.Builder
+		groups = make(map[string]string)
+		last   int
+	)
+	for _, loc := range templateVarRE.FindAllStringSubmatchIndex(targetTmpl, -1) {
+		b.WriteString(regexp.QuoteMeta(targetTmpl[last:loc[0]]))
+		last = loc[1]
+
+		name := strings.TrimSuffix(strings.TrimPrefix(targetTmpl[loc[2]:loc[3]], "{"), "}")
+		if name == "$" {
+			b.WriteString(regexp.QuoteMeta("$"))
+			continue
+		}
+		sub, ok := captures[name]
+		if !ok {
+			// The target uses a group the vanity template can't express.
+			return nil, "", nil
+		}
+		// Each group is captured once; later uses only have to match.
+		if _, seen := groups[name]; seen {
+			b.WriteString("(?:" + sub + ")")
+			continue
+		}
+		groups[name] = fmt.Sprintf("v%d", len(groups))
+		b.WriteString("(?P<" + groups[name] + ">" + sub + ")")
+	}
+	b.WriteString(regexp.QuoteMeta(targetTmpl[last:]))
+
+	// Every group of the vanity template must be recoverable from the target.
+	var missing bool
+	tmpl := templateVarRE.ReplaceAllStringFunc(vanityTmpl, func(m string) string {
+		name := strings.TrimSuffix(strings.TrimPrefix(m[1:], "{"), "}")
+		if name == "$" {
+			return m
+		}
+		g, ok := groups[name]
+		if !ok {
+			missing = true
+			return m
+		}
+		return "${" + g + "}"
+	})
+	if missing {
+		return nil, "", nil
+	}
+
+	re, err := compileBounded(b.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to compile reverse pattern: %w", err)
+	}
+	return re, tmpl, nil
+}
+
+// compileBounded compiles a pattern that must match a prefix of a path ending
+// at a path element boundary, so "example.com/mod" matches
+// "example.com/mod/pkg" but not "example.com/module". The boundary is matched
+// by a trailing group, which keeps the numbering of the pattern's own groups.
+func compileBounded(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")(/|$)")
+}
+
+// match applies one direction of a rule to path. It returns the mapped path
+// and the length of the matched prefix, or -1 if the rule doesn't match.
+//
+// A major version suffix following the match ("/v2", or ".v2" for gopkg.in)
+// is carried over in the style of the mapped path, so a rule for
+// "go.corp.com/lib" also maps "go.corp.com/lib/v2", and gopkg.in paths can be
+// mapped to and from repositories using regular "/vN" suffixes.
+func match(re *regexp.Regexp, tmpl, path string) (string, int) {
+	if re == nil {
+		return "", -1
+	}
+
+	// gopkg.in suffixes are part of a path element, so strip them before
+	// matching. If the rule doesn't end where the suffix was, match the
+	// path as is.
+	if base, major, at, ok := splitGopkgMajor(path); ok {
+		if m := re.FindStringSubmatchIndex(base); m != nil && m[len(m)-2] == at {
+			return expandMajor(re, tmpl, base, m, major, base[at:]), at
+		}
+	}
+
+	m := re.FindStringSubmatchIndex(path)
+	if m == nil {
+		return "", -1
+	}
+	// The last group is the boundary added by compileBounded; the match
+	// proper ends where it starts.
+	end := m[len(m)-2]
+	major, rest := splitMajor(path[:end], path[end:])
+	return expandMajor(re, tmpl, path, m, major, rest), end
+}
+
+// expandMajor builds the mapped path from a match, a major version ("v2", or
+// "" for none) and the rest of the path.
+func expandMajor(re *regexp.Regexp, tmpl, path string, m []int, major, rest string) string {
+	mapped := string(re.ExpandString(nil, tmpl, path, m))
+	if strings.HasPrefix(mapped, "gopkg.in/") {
+		if _, _, ok := module.SplitPathVersion(mapped); !ok {
+			// gopkg.in paths always have a suffix; v0 and v1 of a
+			// path without one are served as .v1.
+			if major == "" {
+				major = "v1"
+			}
+			return mapped + "." + major + rest
+		}
+	} else if major != "" && major != "v0" && major != "v1" {
+		return mapped + "/" + major + rest
+	}
+	return mapped + rest
+}
+
+// splitMajor splits a "/vN" major version suffix off the start of rest, the
+// part of a path following prefix. It returns the major version ("v2") and
+// what follows it, or "" and rest if there is no suffix.
+func splitMajor(prefix, rest string) (string, string) {
+	elem, after, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if elem == "" || !strings.HasPrefix(rest, "/") {
+		return "", rest
+	}
+	if after != "" {
+		after = "/" + after
+	}
+	if p, pathMajor, ok := module.SplitPathVersion(prefix + "/" + elem); ok && p == prefix && pathMajor == "/"+elem {
+		return elem, after
+	}
+	return "", rest
+}
+
+// splitGopkgMajor splits the ".vN" major version suffix off a gopkg.in module
+// or package path. It returns the path without the suffix, the major version
+// ("v3") and the offset the suffix was cut at.
+func splitGopkgMajor(path string) (base, major string, at int, ok bool) {
+	if !strings.HasPrefix(path, "gopkg.in/") {
+		return "", "", 0, false
+	}
+	// The suffix ends the module path, which is either gopkg.in/pkg.vN or
+	// gopkg.in/user/pkg.vN.
+	for i := len("gopkg.in/"); i <= len(path); i++ {
+		if i < len(path) && path[i] != '/' {
+			continue
+		}
+		prefix, pathMajor, ok := module.SplitPathVersion(path[:i])
+		if ok && pathMajor != "" {
+			return prefix + path[i:], pathMajor[1:], len(prefix), true
+		}
+	}
+	return "", "", 0, false
+}
+
+// best returns the most specific rule matching path in one direction: the
+// one matching the longest prefix, then the one with the fewest wildcards,
+// then the first one configured.
+func (rs ruleSet) best(path string, direction func(r *rewriteRule) (*regexp.Regexp, string)) (string, *rewriteRule, bool) {
+	var (
+		bestPath  string
+		bestRule  *rewriteRule
+		bestLen   = -1
+		bestWilds int
+	)
+	for _, r := range rs {
+		re, tmpl := direction(r)
+		mapped, n := match(re, tmpl, path)
+		if n < 0 {
+			continue
+		}
+		if n > bestLen || (n == bestLen && re.NumSubexp() < bestWilds) {
+			bestPath, bestRule, bestLen, bestWilds = mapped, r, n, re.NumSubexp()
+		}
+	}
+	if bestRule == nil {
+		return path, nil, false
+	}
+	return bestPath, bestRule, true
+}
+
+// toTarget maps a vanity path to its target path.
+func (rs ruleSet) toTarget(path string) (string, *rewriteRule, bool) {
+	return rs.best(path, func(r *rewriteRule) (*regexp.Regexp, string) {
+		return r.vanityRE, r.targetTmpl
+	})
+}
+
+// toVanity maps a target path back to its vanity path.
+func (rs ruleSet) toVanity(path string) (string, *rewriteRule, bool) {
+	return rs.best(path, func(r *rewriteRule) (*regexp.Regexp, string) {
+		return r.targetRE, r.vanityTmpl
+	})
+}
+
+// repoRoot returns the vanity prefix the rule matches in path, including any
+// gopkg.in major version suffix, and the target path it maps to without
+// major version suffixes. These are the import prefix and the repository of a
+// go-import meta tag.
+func (r *rewriteRule) repoRoot(path string) (vanity, target string, ok bool) {
+	if base, major, at, ok := splitGopkgMajor(path); ok {
+		if m := r.vanityRE.FindStringSubmatchIndex(base); m != nil && m[len(m)-2] == at {
+			return path[:at+1+len(major)], string(r.vanityRE.ExpandString(nil, r.targetTmpl, base, m)), true
+		}
+	}
+	m := r.vanityRE.FindStringSubmatchIndex(path)
+	if m == nil {
+		return "", "", false
+	}
+	return path[:m[len(m)-2]], string(r.vanityRE.ExpandString(nil, r.targetTmpl, path, m)), true
+}
+
+// patterns returns the vanity side of every rule as GOPRIVATE-style globs.
+func (rs ruleSet) patterns() []string {
+	patterns := make([]string, 0, len(rs))
+	for _, r := range rs {
+		patterns = append(patterns, r.pattern)
+	}
+	return patterns
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileRuleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RewriteRule
+		want string
+	}{
+		{
+			name: "missing target",
+			rule: RewriteRule{VanityPath: "go.corp.com/lib"},
+			want: "missing target_path",
+		},
+		{
+			name: "several vanity patterns",
+			rule: RewriteRule{VanityPath: "go.corp.com/lib", VanityGlob: "go.corp.com/*", TargetPath: "gitlab.corp.com/lib"},
+			want: "exactly one of",
+		},
+		{
+			name: "undefined group",
+			rule: RewriteRule{VanityRegex: `go\.corp\.com/(?P<repo>[^/]+)`, TargetPath: "gitlab.corp.com/${name}"},
+			want: "undefined group ${name}",
+		},
+		{
+			name: "alternation",
+			rule: RewriteRule{VanityRegex: `go\.corp\.com/(?:a|b)`, TargetPath: "gitlab.corp.com/go/ab"},
+			want: "can't be mapped back from target paths",
+		},
+		{
+			name: "unused group",
+			rule: RewriteRule{VanityGlob: "go.corp.com/*/*", TargetPath: "gitlab.corp.com/go/${2}"},
+			want: "must use every group",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileRule(tt.rule)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("compileRule() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulePatterns(t *testing.T) {
+	rs, err := compileRules([]RewriteRule{
+		{VanityPath: "go.corp.com/lib", TargetPath: "gitlab.corp.com/lib"},
+		{VanityGlob: "go.corp.com/x/*", TargetPath: "gitlab.corp.com/x/${1}"},
+		{VanityRegex: `go\.corp\.com/(?P<repo>[^/]+)`, TargetPath: "gitlab.corp.com/go/${repo}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(rs.patterns(), ",")
+	if want := "go.corp.com/lib,go.corp.com/x/*,go.corp.com/*"; got != want {
+		t.Errorf("patterns() = %s, want %s", got, want)
+	}
+}
+
+func TestRuleUnescapedDots(t *testing.T) {
+	rs := mustCompileRules(t, RewriteRule{VanityRegex: `go.corp.com/(?P<repo>[^/]+)`, TargetPath: "gitlab.corp.com/go/${repo}"})
+	if got := strings.Join(rs.patterns(), ","); got != "go.corp.com/*" {
+		t.Errorf("patterns() = %s, want go.corp.com/*", got)
+	}
+	if got, _, ok := rs.toTarget("go.corp.com/repo/pkg"); !ok || got != "gitlab.corp.com/go/repo/pkg" {
+		t.Errorf("toTarget(go.corp.com/repo/pkg) = %s, %v", got, ok)
+	}
+	if got, _, ok := rs.toVanity("gitlab.corp.com/go/repo/pkg"); !ok || got != "go.corp.com/repo/pkg" {
+		t.Errorf("toVanity(gitlab.corp.com/go/repo/pkg) = %s, %v", got, ok)
+	}
+	// The dots match only dots, so other paths can't be mapped to the
+	// same target.
+	if got, _, ok := rs.toTarget("goxcorp.com/repo"); ok {
+		t.Errorf("toTarget(goxcorp.com/repo) = %s, want no match", got)
+	}
+}
+
+func mustCompileRules(t *testing.T, rules ...RewriteRule) ruleSet {
+	t.Helper()
+	rs, err := compileRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestToTarget(t *testing.T) {
+	rs := mustCompileRules(t,
+		RewriteRule{VanityPath: "go.corp.com/lib", TargetPath: "gitlab.corp.com/go/lib"},
+		RewriteRule{VanityPath: "go.corp.com/lib/v3", TargetPath: "gitlab.corp.com/go/lib-v3"},
+		RewriteRule{VanityGlob: "go.corp.com/*", TargetPath: "gitlab.corp.com/go/${1}"},
+		RewriteRule{VanityGlob: "go.corp.com/team/*/*", TargetPath: "gitlab.corp.com/${1}/${2}"},
+		RewriteRule{VanityRegex: `go\.corp\.com/team/(?P<repo>[^/]+)`, TargetPath: "gitlab.corp.com/team/${repo}"},
+		RewriteRule{VanityPath: "gopkg.in/corp", TargetPath: "gitlab.corp.com/go/corp"},
+		RewriteRule{VanityPath: "go.corp.com/yaml", TargetPath: "gopkg.in/yaml"},
+	)
+
+	tests := []struct {
+		path, want string
+		rule       int
+		ok         bool
+	}{
+		// Literal rules, with packages under the module.
+		{"go.corp.com/lib", "gitlab.corp.com/go/lib", 0, true},
+		{"go.corp.com/lib/pkg/sub", "gitlab.corp.com/go/lib/pkg/sub", 0, true},
+		// Whole path elements only: the glob matches, not the literal.
+		{"go.corp.com/library", "gitlab.corp.com/go/library", 2, true},
+		// Major version suffixes are carried over.
+		{"go.corp.com/lib/v2", "gitlab.corp.com/go/lib/v2", 0, true},
+		{"go.corp.com/lib/v2/pkg", "gitlab.corp.com/go/lib/v2/pkg", 0, true},
+		// A rule for a specific major version takes precedence.
+		{"go.corp.com/lib/v3/pkg", "gitlab.corp.com/go/lib-v3/pkg", 1, true},
+		// The longest match wins over the glob...
+		{"go.corp.com/team/a/b", "gitlab.corp.com/a/b", 3, true},
+		// ...and for equal lengths, the fewest wildcards.
+		{"go.corp.com/team/a", "gitlab.corp.com/team/a", 4, true},
+		// gopkg.in suffixes become /vN, and v0/v1 are unversioned.
+		{"gopkg.in/corp.v3", "gitlab.corp.com/go/corp/v3", 5, true},
+		{"gopkg.in/corp.v3/pkg", "gitlab.corp.com/go/corp/v3/pkg", 5, true},
+		{"gopkg.in/corp.v1", "gitlab.corp.com/go/corp", 5, true},
+		// And /vN becomes a gopkg.in suffix, .v1 without one.
+		{"go.corp.com/yaml/v3", "gopkg.in/yaml.v3", 6, true},
+		{"go.corp.com/yaml", "gopkg.in/yaml.v1", 6, true},
+		{"go.corp.com/yaml/v3/pkg", "gopkg.in/yaml.v3/pkg", 6, true},
+		// Unmatched paths are returned as they are.
+		{"github.com/other/x", "github.com/other/x", -1, false},
+		{"go.corp.com", "go.corp.com", -1, false},
+	}
+	for _, tt := range tests {
+		got, rule, ok := rs.toTarget(tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("toTarget(%s) = %s, %v, want %s, %v", tt.path, got, ok, tt.want, tt.ok)
+			continue
+		}
+		if ok && rule != rs[tt.rule] {
+			t.Errorf("toTarget(%s) used rule %s, want %s", tt.path, rule, rs[tt.rule])
+		}
+	}
+}
+
+func TestToVanity(t *testing.T) {
+	rs := mustCompileRules(t,
+		RewriteRule{VanityPath: "go.corp.com/lib", TargetPath: "gitlab.corp.com/go/lib"},
+		RewriteRule{VanityGlob: "go.corp.com/*", TargetPath: "gitlab.corp.com/go/${1}"},
+		RewriteRule{VanityRegex: `go\.corp\.com/x/(?P<a>[^/]+)/(?P<b>[^/]+)`, TargetPath: "gitlab.corp.com/${b}/${a}"},
+		RewriteRule{VanityPath: "gopkg.in/corp", TargetPath: "gitlab.corp.com/go/corp"},
+	)
+
+	tests := []struct {
+		path, want string
+		ok         bool
+	}{
+		{"gitlab.corp.com/go/lib", "go.corp.com/lib", true},
+		{"gitlab.corp.com/go/lib/v2/pkg", "go.corp.com/lib/v2/pkg", true},
+		{"gitlab.corp.com/go/other/pkg", "go.corp.com/other/pkg", true},
+		// Groups are mapped back by name, in any order.
+		{"gitlab.corp.com/two/one", "go.corp.com/x/one/two", true},
+		// /vN suffixes become gopkg.in suffixes.
+		{"gitlab.corp.com/go/corp/v3/pkg", "gopkg.in/corp.v3/pkg", true},
+		{"github.com/other/x", "github.com/other/x", false},
+	}
+	for _, tt := range tests {
+		got, _, ok := rs.toVanity(tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("toVanity(%s) = %s, %v, want %s, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// Every vanity path maps back to itself.
+	for _, vanity := range []string{"go.corp.com/lib/sub", "go.corp.com/x/one/two/pkg", "gopkg.in/corp.v2"} {
+		target, _, _ := rs.toTarget(vanity)
+		if got, _, _ := rs.toVanity(target); got != vanity {
+			t.Errorf("toVanity(toTarget(%s)) = %s (target %s)", vanity, got, target)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	re, err := compileBounded(`go\.corp\.com/([^/]+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, want string
+		n          int
+	}{
+		{"go.corp.com/lib", "gitlab.corp.com/lib", len("go.corp.com/lib")},
+		{"go.corp.com/lib/pkg", "gitlab.corp.com/lib/pkg", len("go.corp.com/lib")},
+		{"go.corp.com/lib/v2/pkg", "gitlab.corp.com/lib/v2/pkg", len("go.corp.com/lib")},
+		{"go.corp.com", "", -1},
+		{"example.com/lib", "", -1},
+	}
+	for _, tt := range tests {
+		got, n := match(re, "gitlab.corp.com/${1}", tt.path)
+		if got != tt.want || n != tt.n {
+			t.Errorf("match(%s) = %s, %d, want %s, %d", tt.path, got, n, tt.want, tt.n)
+		}
+	}
+	if _, n := match(nil, "", "go.corp.com/lib"); n != -1 {
+		t.Errorf("match with a nil expression = %d, want -1", n)
+	}
+}
+
+func TestReverseRule(t *testing.T) {
+	tests := []struct {
+		name                   string
+		vanity, target, mapped string
+		want                   string
+	}{
+		{"literal", `go\.corp\.com/lib`, "gitlab.corp.com/go/lib", "gitlab.corp.com/go/lib/pkg", "go.corp.com/lib"},
+		{"numbered", `go\.corp\.com/([^/]+)`, "gitlab.corp.com/go/${1}", "gitlab.corp.com/go/x", "go.corp.com/x"},
+		{"named and reordered", `go\.corp\.com/(?P<a>[^/]+)/(?P<b>[^/]+)`, "gitlab.corp.com/${b}-${a}", "gitlab.corp.com/y-x", "go.corp.com/x/y"},
+		{"repeated group", `go\.corp\.com/(?P<a>[^/]+)`, "gitlab.corp.com/${a}/${a}", "gitlab.corp.com/x/x", "go.corp.com/x"},
+		{"dollar", `go\.corp\.com/([^/]+)`, "gitlab.corp.com/$$/${1}", "gitlab.corp.com/$/x", "go.corp.com/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vanityTmpl, captures, _, ok := reverseTemplate(tt.vanity)
+			if !ok {
+				t.Fatalf("reverseTemplate(%s) failed", tt.vanity)
+			}
+			re, tmpl, err := reverseRule(tt.target, vanityTmpl, captures)
+			if err != nil || re == nil {
+				t.Fatalf("reverseRule() = %v, %v", re, err)
+			}
+			m := re.FindStringSubmatchIndex(tt.mapped)
+			if m == nil {
+				t.Fatalf("%s doesn't match %s", re, tt.mapped)
+			}
+			if got := string(re.ExpandString(nil, tmpl, tt.mapped, m)); got != tt.want {
+				t.Errorf("mapped back to %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// The target drops a group: the vanity path can't be recovered.
+	vanityTmpl, captures, _, _ := reverseTemplate(`go\.corp\.com/([^/]+)/([^/]+)`)
+	if re, _, err := reverseRule("gitlab.corp.com/${1}", vanityTmpl, captures); re != nil || err != nil {
+		t.Errorf("reverseRule() with a dropped group = %v, %v, want nil", re, err)
+	}
+}
+
+func TestSplitGopkgMajor(t *testing.T) {
+	tests := []struct {
+		path, base, major string
+		ok                bool
+	}{
+		{"gopkg.in/yaml.v3", "gopkg.in/yaml", "v3", true},
+		{"gopkg.in/yaml.v3/pkg", "gopkg.in/yaml/pkg", "v3", true},
+		{"gopkg.in/user/pkg.v2", "gopkg.in/user/pkg", "v2", true},
+		{"gopkg.in/yaml", "", "", false},
+		{"go.corp.com/yaml.v3", "", "", false},
+	}
+	for _, tt := range tests {
+		base, major, _, ok := splitGopkgMajor(tt.path)
+		if base != tt.base || major != tt.major || ok != tt.ok {
+			t.Errorf("splitGopkgMajor(%s) = %s, %s, %v, want %s, %s, %v", tt.path, base, major, ok, tt.base, tt.major, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// sumdbProxy proxies public checksum databases under /sumdb/<name>/, so that
+// the go command can verify modules through GOPROXY without reaching the
+// databases itself. Full tiles and lookups never change once published and
+// are served from the cache: a lookup's records are immutable, and the tree
+// signed along with them stays valid as the log grows. The signed tree head
+// (latest) is kept for a TTL.
+//
+// Files are cached under the names the checksum verifier uses, so both
+// share them.
+type sumdbProxy struct {
+	sumdbs    map[string]*url.URL
+	latestTTL time.Duration
+	client    *http.Client
+	cache     cacheStore
+	logger    *slog.Logger
+
+	fetches flightGroup[[]byte]
+
+	mu     sync.Mutex
+	latest map[string]signedTree
+}
+
+// signedTree is the latest signed tree head of a checksum database.
+type signedTree struct {
+	data      []byte
+	fetchedAt time.Time
+}
+
+// sumdbStatusError is a non-200 response from a checksum database.
+type sumdbStatusError struct {
+	code int
+	body string
+}
+
+func (e *sumdbStatusError) Error() string {
+	return fmt.Sprintf("unexpected status from checksum database: %d %s", e.code, e.body)
+}
+
+// newSumdbProxy returns nil if sumdb proxying is disabled.
+func newSumdbProxy(cfg *Config, cache cacheStore, transport http.RoundTripper, logger *slog.Logger) (*sumdbProxy, error) {
+	c := cfg.SumDBProxy
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	entries := c.SumDBs
+	if len(entries) == 0 {
+		entries = []string{defaultSumDB}
+	}
+	sumdbs := make(map[string]*url.URL, len(entries))
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid proxied sumdb %q: want a name optionally followed by a URL", entry)
+		}
+		name := fields[0]
+		if cfg.PrivateSumDB.Enabled && name == cfg.PrivateSumDB.Name {
+			return nil, fmt.Errorf("proxied sumdb %q is the private checksum database", name)
+		}
+		rawURL := "https://" + name
+		if len(fields) == 2 {
+			rawURL = fields[1]
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL of proxied sumdb %q", name)
+		}
+		sumdbs[name] = u
+	}
+
+	ttl := c.LatestTTL
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+
+	for name, u := range sumdbs {
+		logger.Info("Proxying checksum database", "name", name, "url", u.String())
+	}
+	return &sumdbProxy{
+		sumdbs:    sumdbs,
+		latestTTL: ttl,
+		client:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		cache:     cache,
+		logger:    logger,
+		fetches:   flightGroup[[]byte]{op: "sumdb"},
+		latest:    make(map[string]signedTree),
+	}, nil
+}
+
+// handles reports whether a request path is for a proxied checksum database.
+func (s *sumdbProxy) handles(urlPath string) bool {
+	rest, ok := strings.CutPrefix(urlPath, "/sumdb/")
+	if s == nil || !ok {
+		return false
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return s.sumdbs[name] != nil
+}
+
+func (s *sumdbProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if path.Clean(r.URL.Path) != r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	name, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sumdb/"), "/")
+
+	kind := sumdbKind(file)
+	metrics.GetOrCreateCounter(fmt.Sprintf("toru_sumdb_requests_total{sumdb=%q,kind=%q}", name, kind)).Inc()
+
+	var (
+		data   []byte
+		err    error
+		maxAge time.Duration
+	)
+	switch kind {
+	case "supported":
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.WriteHeader(http.StatusOK)
+		return
+	case "latest":
+		data, err = s.signedTree(r.Context(), name)
+		maxAge = s.latestTTL
+	case "lookup", "tile":
+		data, err = s.immutable(r.Context(), name, file)
+		maxAge = 24 * time.Hour
+	case "partial_tile":
+		data, err = s.fetch(r.Context(), name, file)
+		maxAge = time.Minute
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	var statusErr *sumdbStatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.code < 500:
+		// Unknown modules and versions are reported as they are, so
+		// the go command shows the checksum database's message.
+		http.Error(w, statusErr.body, statusErr.code)
+		return
+	case err != nil:
+		s.logger.Error("Failed to proxy checksum database", "sumdb", name, "file", file, "error", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if kind == "tile" || kind == "partial_tile" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// sumdbKind classifies a checksum database file for routing and metrics.
+func sumdbKind(file string) string {
+	switch {
+	case file == "supported", file == "latest":
+		return file
+	case strings.HasPrefix(file, "lookup/"):
+		return "lookup"
+	case strings.HasPrefix(file, "tile/"):
+		t, err := tlog.ParseTilePath(file)
+		if err != nil {
+			return "other"
+		}
+		if t.W < 1<<t.H {
+			return "partial_tile"
+		}
+		return "tile"
+	}
+	return "other"
+}
+
+// signedTree returns the latest signed tree head of a checksum database,
+// fetched again once it is older than the TTL. If the database can't be
+// reached, the previous one is served: it is still a valid, if older, tree.
+func (s *sumdbProxy) signedTree(ctx context.Context, name string) ([]byte, error) {
+	s.mu.Lock()
+	cached, ok := s.latest[name]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < s.latestTTL {
+		sumdbCacheHit(name, "latest")
+		return cached.data, nil
+	}
+
+	data, err := s.fetch(ctx, name, "latest")
+	if err != nil {
+		if !ok {
+			return nil, err
+		}
+		s.logger.Warn("Serving stale checksum database tree", "sumdb", name, "age", time.Since(cached.fetchedAt), "error", err)
+		return cached.data, nil
+	}
+
+	s.mu.Lock()
+	s.latest[name] = signedTree{data: data, fetchedAt: time.Now()}
+	s.mu.Unlock()
+	return data, nil
+}
+
+// immutable returns a file that never changes once published, from the
+// cache if possible.
+func (s *sumdbProxy) immutable(ctx context.Context, name, file string) ([]byte, error) {
+	key := "sumdb/" + name + "/" + file
+	if s.cache != nil {
+		rc, err := s.cache.Get(ctx, key)
+		if err == nil {
+			defer rc.Close()
+			sumdbCacheHit(name, sumdbKind(file))
+			return io.ReadAll(rc)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("Failed to read cached checksum database file", "key", key, "error", err)
+		}
+	}
+
+	data, err := s.fetch(ctx, name, file)
+	if err != nil {
+		return nil, err
+	}
+	if s.cache != nil {
+		if err := s.cache.Put(ctx, key, bytes.NewReader(data)); err != nil {
+			s.logger.Warn("Failed to cache checksum database file", "key", key, "error", err)
+		}
+	}
+	return data, nil
+}
+
+// fetch reads a file from a checksum database. Concurrent fetches of the
+// same file are shared.
+func (s *sumdbProxy) fetch(ctx context.Context, name, file string) ([]byte, error) {
+	return s.fetches.do(ctx, name+"/"+file, func(ctx context.Context) ([]byte, error) {
+		startTime := time.Now()
+		defer metrics.GetOrCreateSummary(fmt.Sprintf("toru_sumdb_upstream_duration_seconds{sumdb=%q}", name)).UpdateDuration(startTime)
+
+		data, err := s.get(ctx, strings.TrimSuffix(s.sumdbs[name].String(), "/")+"/"+file)
+		var statusErr *sumdbStatusError
+		if err != nil && !(errors.As(err, &statusErr) && statusErr.code < 500) {
+			metrics.GetOrCreateCounter(fmt.Sprintf("toru_sumdb_upstream_errors_total{sumdb=%q}", name)).Inc()
+		}
+		return data, err
+	})
+}
+
+func (s *sumdbProxy) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, &sumdbStatusError{code: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	// Tiles are at most 8KiB and lookups a few, so this only guards
+	// against misbehaving servers.
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func sumdbCacheHit(name, kind string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf("toru_sumdb_cache_hits_total{sumdb=%q,kind=%q}", name, kind)).Inc()
+}
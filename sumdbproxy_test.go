@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goproxy/goproxy"
+)
+
+// fakeSumDB is a checksum database that counts requests per path and answers
+// with a fixed status.
+type fakeSumDB struct {
+	mu     sync.Mutex
+	status int
+	body   string
+	hits   map[string]int
+}
+
+func (db *fakeSumDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.hits[r.URL.Path]++
+	if db.status != http.StatusOK {
+		http.Error(w, db.body, db.status)
+		return
+	}
+	io.WriteString(w, db.body+" "+r.URL.Path)
+}
+
+func (db *fakeSumDB) set(status int, body string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.status, db.body = status, body
+}
+
+func (db *fakeSumDB) count(p string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.hits[p]
+}
+
+func newTestSumdbProxy(t *testing.T) (*sumdbProxy, *fakeSumDB) {
+	t.Helper()
+	db := &fakeSumDB{status: http.StatusOK, body: "v1", hits: make(map[string]int)}
+	srv := httptest.NewServer(db)
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{}
+	cfg.SumDBProxy.Enabled = true
+	cfg.SumDBProxy.SumDBs = []string{"sum.example.com " + srv.URL}
+	cfg.SumDBProxy.LatestTTL = time.Minute
+	cache := &diskCacher{DirCacher: goproxy.DirCacher(t.TempDir())}
+	s, err := newSumdbProxy(cfg, cache, http.DefaultTransport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+// sumdbGet requests a file of the proxied database and returns the response
+// status and body.
+func sumdbGet(t *testing.T, s *sumdbProxy, file string) (int, string) {
+	t.Helper()
+	urlPath := "/sumdb/sum.example.com/" + file
+	if !s.handles(urlPath) {
+		t.Fatalf("%s is not handled", urlPath)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, urlPath, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestSumdbProxyLatest(t *testing.T) {
+	s, db := newTestSumdbProxy(t)
+
+	if code, body := sumdbGet(t, s, "latest"); code != http.StatusOK || body != "v1 /latest" {
+		t.Fatalf("latest = %d %q", code, body)
+	}
+	db.set(http.StatusOK, "v2")
+	if _, body := sumdbGet(t, s, "latest"); body != "v1 /latest" {
+		t.Errorf("latest within the TTL = %q, want the cached tree", body)
+	}
+	if n := db.count("/latest"); n != 1 {
+		t.Errorf("upstream latest fetches = %d, want 1", n)
+	}
+
+	// Once the TTL expires, the tree is fetched again.
+	s.latest["sum.example.com"] = signedTree{data: s.latest["sum.example.com"].data, fetchedAt: time.Now().Add(-2 * time.Minute)}
+	if _, body := sumdbGet(t, s, "latest"); body != "v2 /latest" {
+		t.Errorf("latest after the TTL = %q, want the new tree", body)
+	}
+
+	// If the database is down, the previous tree is served.
+	s.latest["sum.example.com"] = signedTree{data: s.latest["sum.example.com"].data, fetchedAt: time.Now().Add(-2 * time.Minute)}
+	db.set(http.StatusServiceUnavailable, "down")
+	if code, body := sumdbGet(t, s, "latest"); code != http.StatusOK || body != "v2 /latest" {
+		t.Errorf("stale latest = %d %q, want the previous tree", code, body)
+	}
+}
+
+func TestSumdbProxyLatestUnavailable(t *testing.T) {
+	s, db := newTestSumdbProxy(t)
+	db.set(http.StatusInternalServerError, "down")
+	if code, _ := sumdbGet(t, s, "latest"); code != http.StatusBadGateway {
+		t.Errorf("latest without a previous tree = %d, want 502", code)
+	}
+}
+
+func TestSumdbProxyImmutable(t *testing.T) {
+	for _, file := range []string{
+		"lookup/example.com/m@v1.0.0",
+		"tile/8/0/000",
+		"tile/8/1/002",
+		"tile/8/data/000",
+	} {
+		t.Run(file, func(t *testing.T) {
+			s, db := newTestSumdbProxy(t)
+			want := "v1 /" + file
+			if code, body := sumdbGet(t, s, file); code != http.StatusOK || body != want {
+				t.Fatalf("first fetch = %d %q, want %q", code, body, want)
+			}
+
+			// Later requests are served from the cache, even if the
+			// database is down.
+			db.set(http.StatusInternalServerError, "down")
+			if code, body := sumdbGet(t, s, file); code != http.StatusOK || body != want {
+				t.Errorf("cached fetch = %d %q, want %q", code, body, want)
+			}
+			if n := db.count("/" + file); n != 1 {
+				t.Errorf("upstream fetches = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestSumdbProxyPartialTile(t *testing.T) {
+	s, db := newTestSumdbProxy(t)
+	const file = "tile/8/0/000.p/5"
+	for range 2 {
+		if code, body := sumdbGet(t, s, file); code != http.StatusOK || body != "v1 /"+file {
+			t.Fatalf("partial tile = %d %q", code, body)
+		}
+	}
+	if n := db.count("/" + file); n != 2 {
+		t.Errorf("upstream fetches = %d, want 2: partial tiles must not be cached", n)
+	}
+
+	db.set(http.StatusInternalServerError, "down")
+	if code, _ := sumdbGet(t, s, file); code != http.StatusBadGateway {
+		t.Errorf("partial tile with the database down = %d, want 502", code)
+	}
+}
+
+func TestSumdbProxyErrors(t *testing.T) {
+	tests := []struct {
+		status   int
+		wantCode int
+		wantBody string
+	}{
+		{http.StatusNotFound, http.StatusNotFound, "not found: example.com/m@v1.0.0\n"},
+		{http.StatusGone, http.StatusGone, "not found: example.com/m@v1.0.0\n"},
+		{http.StatusInternalServerError, http.StatusBadGateway, "Bad Gateway\n"},
+		{http.StatusServiceUnavailable, http.StatusBadGateway, "Bad Gateway\n"},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			s, db := newTestSumdbProxy(t)
+			db.set(tt.status, "not found: example.com/m@v1.0.0")
+			code, body := sumdbGet(t, s, "lookup/example.com/m@v1.0.0")
+			if code != tt.wantCode || body != tt.wantBody {
+				t.Errorf("lookup = %d %q, want %d %q", code, body, tt.wantCode, tt.wantBody)
+			}
+
+			// Errors are not cached.
+			db.set(http.StatusOK, "v1")
+			if code, _ := sumdbGet(t, s, "lookup/example.com/m@v1.0.0"); code != http.StatusOK {
+				t.Errorf("lookup after recovery = %d, want 200", code)
+			}
+		})
+	}
+}
+
+func TestSumdbProxyHandles(t *testing.T) {
+	s, _ := newTestSumdbProxy(t)
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/sumdb/sum.example.com/supported", true},
+		{"/sumdb/sum.example.com/latest", true},
+		{"/sumdb/sum.golang.org/latest", false},
+		{"/example.com/m/@v/list", false},
+	} {
+		if got := s.handles(tt.path); got != tt.want {
+			t.Errorf("handles(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	var disabled *sumdbProxy
+	if disabled.handles("/sumdb/sum.example.com/latest") {
+		t.Error("a disabled proxy handles requests")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// toolchainModule is the module the go command downloads Go toolchains from
+// when GOTOOLCHAIN selects a newer release than the local one.
+const toolchainModule = "golang.org/toolchain"
+
+// toolchainVersionPrefix prefixes the Go version and platform in the module
+// versions of toolchains, e.g. v0.0.1-go1.23.4.linux-amd64.
+const toolchainVersionPrefix = "v0.0.1-"
+
+// toolchains restricts the Go toolchains served and pre-warms the cache with
+// some of them. Toolchain zips are large (60MB+), so they are never rewritten
+// or scanned for licenses.
+type toolchains struct {
+	versions  []string
+	platforms []string
+	prewarm   []string
+}
+
+// newToolchains returns nil if no toolchain is restricted or pre-warmed.
+func newToolchains(cfg *Config) (*toolchains, error) {
+	c := cfg.Toolchain
+	if len(c.Versions) == 0 && len(c.Platforms) == 0 && len(c.Prewarm) == 0 {
+		return nil, nil
+	}
+	for _, p := range slices.Concat(c.Versions, c.Platforms) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid toolchain pattern %q: %w", p, err)
+		}
+	}
+
+	t := &toolchains{versions: c.Versions, platforms: c.Platforms}
+	for _, name := range c.Prewarm {
+		version := toolchainVersionPrefix + strings.TrimPrefix(name, toolchainVersionPrefix)
+		if _, _, ok := parseToolchainVersion(version); !ok {
+			return nil, fmt.Errorf("invalid toolchain to pre-warm %q: want a name such as go1.23.4.linux-amd64", name)
+		}
+		if !t.allowed(version) {
+			return nil, fmt.Errorf("toolchain to pre-warm %q is not allowed by the toolchain versions and platforms", name)
+		}
+		t.prewarm = append(t.prewarm, version)
+	}
+	if len(t.prewarm) > 0 && !cfg.Cache.Enabled {
+		return nil, fmt.Errorf("pre-warming toolchains requires the cache")
+	}
+	return t, nil
+}
+
+// parseToolchainVersion splits the module version of a toolchain into its Go
+// version and platform, e.g. "go1.23.4" and "linux-amd64".
+func parseToolchainVersion(version string) (goVersion, platform string, ok bool) {
+	rest, ok := strings.CutPrefix(version, toolchainVersionPrefix)
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, ".")
+	if i < 0 || !strings.HasPrefix(rest, "go") {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// allowed reports whether a toolchain version matches the configured Go
+// version and platform patterns. Empty pattern lists match everything.
+func (t *toolchains) allowed(version string) bool {
+	goVersion, platform, ok := parseToolchainVersion(version)
+	if !ok {
+		return false
+	}
+	return matchAny(t.versions, goVersion) && matchAny(t.platforms, platform)
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a deniedError for toolchain versions that aren't served.
+func (t *toolchains) check(path, version string) error {
+	if t == nil || path != toolchainModule || version == "" || t.allowed(version) {
+		return nil
+	}
+	toolchainDeniedTotal.Inc()
+	return &deniedError{fmt.Sprintf("toolchain %s is not served by this proxy", strings.TrimPrefix(version, toolchainVersionPrefix))}
+}
+
+// filter returns the toolchain versions that are served.
+func (t *toolchains) filter(path string, versions []string) []string {
+	if t == nil || path != toolchainModule || (len(t.versions) == 0 && len(t.platforms) == 0) {
+		return versions
+	}
+	shown := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if t.allowed(v) {
+			shown = append(shown, v)
+		}
+	}
+	return shown
+}
+
+// prewarmToolchains downloads the configured toolchains that aren't cached
+// yet. Failures are logged, so that a toolchain missing upstream doesn't
+// keep the others from being cached.
+func (f *fetcher) prewarmToolchains(ctx context.Context) {
+	if f.toolchains == nil {
+		return
+	}
+	for _, version := range f.toolchains.prewarm {
+		startTime := time.Now()
+		cached, err := f.cacheVersion(ctx, toolchainModule, version)
+		if err != nil {
+			f.logger.Error("Failed to pre-warm toolchain", "version", version, "error", err)
+			continue
+		}
+		if !cached {
+			toolchainPrewarmedTotal.Inc()
+			f.logger.Info("Pre-warmed toolchain", "version", version, "duration", time.Since(startTime))
+		}
+	}
+}
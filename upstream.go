@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+const defaultGOPROXY = "https://proxy.golang.org,direct"
+
+// upstreamEnv builds the fetch environment from the [upstream] config. The
+// GOPROXY list and GONOPROXY are used by the proxy client; the rest applies
+// to direct fetches made with the go command. The vanity patterns of rewrite
+// rules are always added to GOPRIVATE, GONOPROXY and GONOSUMDB.
+func upstreamEnv(cfg *Config, rules ruleSet) ([]string, error) {
+	u := cfg.Upstream
+
+	goproxy := u.Proxy
+	if goproxy == "" {
+		goproxy = defaultGOPROXY
+	}
+	if err := validateGOPROXY(goproxy); err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+	}
+	// Direct fetches and checksum verification use the same database.
+	gosumdb := sumDB(cfg)
+	if gosumdb != "" {
+		if err := validateGOSUMDB(gosumdb); err != nil {
+			return nil, fmt.Errorf("invalid upstream sumdb: %w", err)
+		}
+	}
+	for _, p := range []struct {
+		name, value string
+	}{
+		{"nosumdb", u.NoSumDB},
+		{"checksum nosumdb", cfg.Checksum.NoSumDB},
+		{"private", u.Private},
+		{"insecure", u.Insecure},
+	} {
+		if err := validatePatterns(p.value); err != nil {
+			return nil, fmt.Errorf("invalid upstream %s: %w", p.name, err)
+		}
+	}
+	if err := validateGOVCS(u.VCS); err != nil {
+		return nil, fmt.Errorf("invalid upstream vcs: %w", err)
+	}
+
+	private := joinPatterns(u.Private, strings.Join(rules.patterns(), ","))
+	env := append(os.Environ(),
+		"GOPROXY="+goproxy,
+		"GOPRIVATE="+private,
+		"GONOPROXY="+private,
+		"GOINSECURE="+u.Insecure,
+	)
+	// GONOSUMDB replaces GOPRIVATE for checksum verification, so it has to
+	// cover the private patterns too. The checksum settings apply to
+	// direct fetches as well, so that both agree on what is verified.
+	if nosumdb := noSumDB(cfg); nosumdb != "" {
+		env = append(env, "GONOSUMDB="+joinPatterns(nosumdb, private))
+	}
+	if gosumdb != "" {
+		env = append(env, "GOSUMDB="+gosumdb)
+	}
+	if u.VCS != "" {
+		env = append(env, "GOVCS="+u.VCS)
+	}
+	return env, nil
+}
+
+// logUpstream logs the upstream settings of the go command environment.
+func logUpstream(env []string, logger *slog.Logger) {
+	args := []any{}
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		switch k {
+		case "GOPROXY", "GOSUMDB", "GONOSUMDB", "GOPRIVATE", "GONOPROXY", "GOINSECURE", "GOVCS":
+			args = append(args, k, v)
+		}
+	}
+	logger.Info("Upstream configuration", args...)
+}
+
+// validateGOPROXY checks a GOPROXY list: URLs, "direct" or "off" separated by
+// ',' (fall back on 404 and 410) or '|' (fall back on any error).
+func validateGOPROXY(list string) error {
+	for _, elem := range strings.Split(strings.ReplaceAll(list, "|", ","), ",") {
+		elem = strings.TrimSpace(elem)
+		switch elem {
+		case "":
+			return fmt.Errorf("empty element in %q", list)
+		case "direct", "off":
+			continue
+		}
+		u, err := url.Parse(elem)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL %q: %w", elem, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" {
+			return fmt.Errorf("invalid proxy URL %q: scheme must be http, https or file", elem)
+		}
+	}
+	return nil
+}
+
+// validateGOSUMDB checks a GOSUMDB value: "off", a known database name, or a
+// verifier key optionally followed by a URL.
+func validateGOSUMDB(value string) error {
+	if value == "off" {
+		return nil
+	}
+	fields := strings.Fields(value)
+	switch {
+	case len(fields) == 0 || len(fields) > 2:
+		return fmt.Errorf("%q must be a name, a key or a key and a URL", value)
+	case fields[0] == defaultSumDB || fields[0] == "sum.golang.google.cn":
+	default:
+		if _, err := note.NewVerifier(fields[0]); err != nil {
+			return fmt.Errorf("invalid key %q: %w", fields[0], err)
+		}
+	}
+	if len(fields) == 2 {
+		if _, err := url.Parse(fields[1]); err != nil {
+			return fmt.Errorf("invalid URL %q: %w", fields[1], err)
+		}
+	}
+	return nil
+}
+
+// validatePatterns checks a comma-separated list of module path glob patterns.
+func validatePatterns(list string) error {
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// validateGOVCS checks a GOVCS value: comma-separated pattern:vcs1|vcs2 pairs.
+func validateGOVCS(value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		pattern, list, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok || pattern == "" || list == "" {
+			return fmt.Errorf("%q must be of the form pattern:vcs", item)
+		}
+		if pattern != "public" && pattern != "private" {
+			if err := validatePatterns(pattern); err != nil {
+				return err
+			}
+		}
+		for _, vcs := range strings.Split(list, "|") {
+			switch vcs {
+			case "all", "off", "git", "hg", "svn", "bzr", "fossil":
+			default:
+				return fmt.Errorf("unknown vcs %q", vcs)
+			}
+		}
+	}
+	return nil
+}
+
+// envValue returns the last value of key in env.
+func envValue(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, ok := strings.Cut(env[i], "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// joinPatterns joins non-empty comma-separated pattern lists.
+func joinPatterns(lists ...string) string {
+	var nonEmpty []string
+	for _, l := range lists {
+		if l != "" {
+			nonEmpty = append(nonEmpty, l)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
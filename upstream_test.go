@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUpstreamEnvSumDB(t *testing.T) {
+	t.Setenv("GOSUMDB", "")
+	tests := []struct {
+		upstream, checksum string
+		want               string
+	}{
+		{"", "", ""},
+		{"sum.golang.google.cn", "", "sum.golang.google.cn"},
+		{"", "sum.golang.google.cn", "sum.golang.google.cn"},
+		{"sum.golang.org", "sum.golang.google.cn", "sum.golang.google.cn"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		cfg.Upstream.SumDB = tt.upstream
+		cfg.Checksum.SumDB = tt.checksum
+		env, err := upstreamEnv(cfg, ruleSet{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The last value of a variable wins.
+		var got string
+		for _, e := range env {
+			if v, ok := strings.CutPrefix(e, "GOSUMDB="); ok {
+				got = v
+			}
+		}
+		if got != tt.want {
+			t.Errorf("upstream %q, checksum %q: GOSUMDB = %q, want %q", tt.upstream, tt.checksum, got, tt.want)
+		}
+		if db := sumDB(cfg); db != got {
+			t.Errorf("upstream %q, checksum %q: verifier uses %q, direct fetches %q", tt.upstream, tt.checksum, db, got)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"golang.org/x/mod/semver"
+)
+
+// Vulnerability modes.
+const (
+	vulnWarn  = "warn"
+	vulnBlock = "block"
+	vulnHide  = "hide"
+)
+
+// vulnHeader lists the vulnerabilities of a served version.
+const vulnHeader = "X-Toru-Vulnerabilities"
+
+// severities ranks the severities found in OSV entries. Entries without one,
+// such as every entry of the Go vulnerability database, rank 0.
+var severities = map[string]int{
+	"low":      1,
+	"moderate": 2,
+	"medium":   2,
+	"high":     3,
+	"critical": 4,
+}
+
+// osvEntry is the subset of an OSV entry used to match module versions.
+type osvEntry struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Summary  string   `json:"summary,omitempty"`
+	Affected []struct {
+		Package struct {
+			Name      string `json:"name"`
+			Ecosystem string `json:"ecosystem"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string `json:"type"`
+			Events []struct {
+				Introduced   string `json:"introduced,omitempty"`
+				Fixed        string `json:"fixed,omitempty"`
+				LastAffected string `json:"last_affected,omitempty"`
+			} `json:"events"`
+		} `json:"ranges,omitempty"`
+		Versions []string `json:"versions,omitempty"`
+	} `json:"affected"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity,omitempty"`
+	} `json:"database_specific"`
+}
+
+// vuln is a vulnerability of a module.
+type vuln struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Summary  string   `json:"summary,omitempty"`
+	Severity string   `json:"severity,omitempty"`
+
+	entry *osvEntry
+	// affected is the index of the module's affected entry.
+	affected int
+}
+
+// vulnDB is an offline snapshot of a vulnerability database in OSV format,
+// such as a mirror of vuln.go.dev, used to warn about, block or hide
+// vulnerable versions.
+type vulnDB struct {
+	path        string
+	mode        string
+	minSeverity int
+	ignore      map[string]bool
+	logger      *slog.Logger
+
+	current atomic.Pointer[vulnIndex]
+}
+
+type vulnIndex struct {
+	modules  map[string][]*vuln
+	entries  int
+	loadedAt time.Time
+}
+
+func newVulnDB(cfg *Config, logger *slog.Logger) (*vulnDB, error) {
+	c := cfg.VulnDB
+	if c.Path == "" {
+		return nil, fmt.Errorf("missing vulnerability database path")
+	}
+
+	db := &vulnDB{
+		path:   c.Path,
+		mode:   c.Mode,
+		ignore: make(map[string]bool),
+		logger: logger,
+	}
+	switch db.mode {
+	case "":
+		db.mode = vulnWarn
+	case vulnWarn, vulnBlock, vulnHide:
+	default:
+		return nil, fmt.Errorf("invalid vulnerability mode %q: must be %q, %q or %q", c.Mode, vulnWarn, vulnBlock, vulnHide)
+	}
+	if c.MinSeverity != "" {
+		n, ok := severities[strings.ToLower(c.MinSeverity)]
+		if !ok {
+			return nil, fmt.Errorf("invalid vulnerability severity %q", c.MinSeverity)
+		}
+		db.minSeverity = n
+	}
+	for _, id := range c.Ignore {
+		db.ignore[id] = true
+	}
+
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	metrics.GetOrCreateGauge("toru_vulndb_entries", func() float64 {
+		return float64(db.current.Load().entries)
+	})
+	return db, nil
+}
+
+// refresh loads the database from disk again. The current snapshot is kept
+// if it fails.
+func (db *vulnDB) refresh() error {
+	startTime := time.Now()
+	idx := &vulnIndex{modules: make(map[string][]*vuln), loadedAt: startTime}
+	err := filepath.WalkDir(db.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		// Index files of the database aren't entries and are skipped.
+		e := &osvEntry{}
+		if err := json.Unmarshal(data, e); err != nil || e.ID == "" || len(e.Affected) == 0 {
+			return nil
+		}
+		if db.ignore[e.ID] {
+			return nil
+		}
+
+		idx.entries++
+		for i, a := range e.Affected {
+			if a.Package.Ecosystem != "" && a.Package.Ecosystem != "Go" {
+				continue
+			}
+			idx.modules[a.Package.Name] = append(idx.modules[a.Package.Name], &vuln{
+				ID:       e.ID,
+				Aliases:  e.Aliases,
+				Summary:  e.Summary,
+				Severity: e.DatabaseSpecific.Severity,
+				entry:    e,
+				affected: i,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		vulnDBRefreshErrorsTotal.Inc()
+		return fmt.Errorf("failed to load vulnerability database: %w", err)
+	}
+
+	db.current.Store(idx)
+	db.logger.Info("Loaded vulnerability database", "path", db.path, "entries", idx.entries, "modules", len(idx.modules), "duration", time.Since(startTime))
+	return nil
+}
+
+// lookup returns the known vulnerabilities of a module version.
+func (db *vulnDB) lookup(path, version string) []*vuln {
+	if db == nil {
+		return nil
+	}
+	var vulns []*vuln
+	for _, v := range db.current.Load().modules[path] {
+		if v.affects(version) {
+			vulns = append(vulns, v)
+		}
+	}
+	sort.Slice(vulns, func(i, j int) bool { return vulns[i].ID < vulns[j].ID })
+	return vulns
+}
+
+// affects reports whether version is in the affected versions of v. Range
+// events are expected in order, as OSV requires.
+func (v *vuln) affects(version string) bool {
+	a := v.entry.Affected[v.affected]
+	for _, av := range a.Versions {
+		if "v"+strings.TrimPrefix(av, "v") == version {
+			return true
+		}
+	}
+	if len(a.Ranges) == 0 {
+		return len(a.Versions) == 0
+	}
+
+	for _, r := range a.Ranges {
+		if r.Type != "SEMVER" && r.Type != "ECOSYSTEM" {
+			continue
+		}
+		affected := false
+		for _, e := range r.Events {
+			switch {
+			case e.Introduced != "":
+				if e.Introduced == "0" || semver.Compare(version, "v"+strings.TrimPrefix(e.Introduced, "v")) >= 0 {
+					affected = true
+				}
+			case e.Fixed != "":
+				if semver.Compare(version, "v"+strings.TrimPrefix(e.Fixed, "v")) >= 0 {
+					affected = false
+				}
+			case e.LastAffected != "":
+				if semver.Compare(version, "v"+strings.TrimPrefix(e.LastAffected, "v")) > 0 {
+					affected = false
+				}
+			}
+		}
+		if affected {
+			return true
+		}
+	}
+	return false
+}
+
+// severe reports whether any of vulns reaches the severity that blocks or
+// hides a version.
+func (db *vulnDB) severe(vulns []*vuln) bool {
+	for _, v := range vulns {
+		if severities[strings.ToLower(v.Severity)] >= db.minSeverity {
+			return true
+		}
+	}
+	return false
+}
+
+// check looks up the vulnerabilities of a version being served. They are
+// logged and reported to the client in a response header. In block mode, and
+// in hide mode for queries, a deniedError is returned for severe ones.
+func (db *vulnDB) check(ctx context.Context, path, version string, query bool) error {
+	vulns := db.lookup(path, version)
+	if len(vulns) == 0 {
+		return nil
+	}
+
+	ids := vulnIDs(vulns)
+	if db.mode == vulnBlock || (db.mode == vulnHide && query) {
+		if db.severe(vulns) {
+			metrics.GetOrCreateCounter(fmt.Sprintf("toru_vuln_blocked_total{mode=%q}", db.mode)).Inc()
+			db.logger.Warn("Refused vulnerable module version", "module", path, "version", version, "vulns", ids)
+			return &deniedError{fmt.Sprintf("%s@%s has known vulnerabilities: %s", path, version, describeVulns(vulns))}
+		}
+	}
+
+	vulnWarningsTotal.Inc()
+	db.logger.Warn("Serving vulnerable module version", "module", path, "version", version, "vulns", ids)
+	noteVulns(ctx, strings.Join(ids, ", "))
+	return nil
+}
+
+// filter returns the versions of a module that aren't hidden.
+func (db *vulnDB) filter(path string, versions []string) []string {
+	if db == nil || db.mode != vulnHide || len(db.current.Load().modules[path]) == 0 {
+		return versions
+	}
+	shown := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if db.severe(db.lookup(path, v)) {
+			metrics.GetOrCreateCounter(fmt.Sprintf("toru_vuln_blocked_total{mode=%q}", db.mode)).Inc()
+			continue
+		}
+		shown = append(shown, v)
+	}
+	return shown
+}
+
+func vulnIDs(vulns []*vuln) []string {
+	ids := make([]string, len(vulns))
+	for i, v := range vulns {
+		ids[i] = v.ID
+	}
+	return ids
+}
+
+func describeVulns(vulns []*vuln) string {
+	descs := make([]string, len(vulns))
+	for i, v := range vulns {
+		descs[i] = v.ID
+		if v.Summary != "" {
+			descs[i] += " (" + v.Summary + ")"
+		}
+	}
+	return strings.Join(descs, ", ")
+}
+
+// vulnsKey is the context key of the vulnerabilities reported for a
+// request.
+type vulnsKey struct{}
+
+// withVulnNotice returns a context in which the vulnerabilities of the
+// served version can be noted.
+func withVulnNotice(ctx context.Context) (context.Context, *atomic.Pointer[string]) {
+	notice := &atomic.Pointer[string]{}
+	return context.WithValue(ctx, vulnsKey{}, notice), notice
+}
+
+// noteVulns records the vulnerabilities reported in the response of the
+// request of ctx.
+func noteVulns(ctx context.Context, ids string) {
+	if notice, ok := ctx.Value(vulnsKey{}).(*atomic.Pointer[string]); ok {
+		notice.Store(&ids)
+	}
+}